@@ -1,9 +1,11 @@
 package levi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,58 +22,247 @@ type Lv struct {
 	echo.Context
 	Logs []Log
 
+	// Fields are attached to the whole request, see Tag.
+	Fields Kv
+
+	// Pool is the snapshot of the postgres connection pool,
+	// taken when the request is finished.
+	Pool *pg.PoolStats
+
+	app      *App
+	id       string
+	trace    traceparent
+	span     *Span
+	level    Logotype
+	sample   float64
 	started  time.Time
 	finished time.Time
 
-	wg sync.WaitGroup
+	// guards Logs and Fields, written to by the jobs,
+	// and the jobs themselves
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+	jobs map[int]string // running, by spawn order; "" for Go
+	seq  int
+	// set once End gives up on the stuck jobs
+	abandoned bool
+	cancel    context.CancelFunc
+
+	// see Paperwork, guarded by mu
+	tx *pg.Tx
+
+	// see Detach
+	pending  []pendingWork
+	launched bool
+	detached string
 }
 
 // Go performs an asynchronous job as part of a request.
 //
 // Request is not considered elapsed until all jobs are
-// finished; request Logs are not getting flushed either.
+// finished (or JobTimeout passes); request Logs are not
+// getting flushed either. The job has no context of its
+// own, but lv.Ctx() is done once the request times out or
+// End gives up on the job. See Group for the jobs that take
+// a context and may fail.
 func (lv *Lv) Go(job func()) {
+	lv.spawn("", job)
+}
+
+// GoNamed is Go for a named job: the logs made through the
+// entry it's given are tagged with the name, and get their
+// own section in the report.
+//
+//	lv.GoNamed("thumbnail", func(log *levi.Entry) {
+//		log.Debug("resizing", img.ID)
+//	})
+//
+func (lv *Lv) GoNamed(name string, job func(*Entry)) {
+	entry := &Entry{lv: lv, job: name}
+	lv.spawn(name, func() { job(entry) })
+}
+
+func (lv *Lv) spawn(name string, job func()) {
+	lv.refuseAtomic(name)
+
+	span := lv.span.Child(strings.TrimSpace("go " + name))
+	started := time.Now()
+
+	lv.mu.Lock()
+	lv.seq++
+	id := lv.seq
+	if lv.jobs == nil {
+		lv.jobs = map[int]string{}
+	}
+	lv.jobs[id] = name
+	lv.mu.Unlock()
+
+	lv.wg.Add(1)
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
 				err := errors.New(fmt.Sprintf("%v", r))
-				lv.Panicf("%+v", err)
-				lv.wg.Done()
+				(&Entry{lv: lv, job: name}).Panicf("%+v", err)
+				span.End(err)
 			}
+			lv.app.metrics.job(time.Since(started))
+
+			lv.mu.Lock()
+			delete(lv.jobs, id)
+			lv.mu.Unlock()
+			lv.wg.Done()
 		}()
 
 		job()
-		lv.wg.Done()
+		span.End(nil)
 	}()
-
-	lv.wg.Add(1)
 }
 
 func (lv *Lv) Begin() {
 	lv.started = time.Now()
+	lv.level, lv.sample = lv.app.level, lv.app.cfg.LogSample
+	lv.identify()
+	lv.span = lv.rootSpan()
+
+	ctx := withSpan(lv.Ctx(), lv.span)
+	if timeout := lv.app.cfg.RequestTimeout; timeout > 0 {
+		ctx, lv.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, lv.cancel = context.WithCancel(ctx)
+	}
+	lv.SetRequest(lv.Request().WithContext(ctx))
 
-	req := lv.Request()
-	method, path := req.Method, req.URL.Path
-	header := "INCOMING " + method + " " + path
-	header += "NOW " + lv.started.Format(time.RFC3339)
-	header += "ADDR " + lv.Addr()
-	header += "AGENT " + lv.Agent()
 	lv.inb4()
-	header += "START"
-	lv.log(PRINT, header)
 }
 
 func (lv *Lv) End(err error) {
-	if err != nil {
+	status := lv.Response().Status
+
+	// the client errors are hardly the server's problem
+	switch {
+	case err != nil && status < 500:
+		lv.Warn(err)
+		err = nil
+	case err != nil:
 		lv.Error(err)
+	case status >= 500:
+		err = errors.New(http.StatusText(status))
 	}
 
-	lv.wg.Wait()
+	lv.waitJobs()
+	lv.cancel()
 	lv.finished = time.Now()
-	lv.logf(PRINT, "FINISHED WITH %d ELAPSED %s\n\n",
-		lv.Response().Status,
-		lv.finished.Sub(lv.started))
-	logger.Report(lv)
+	if db := lv.app.db; db != nil {
+		lv.Pool = db.PoolStats()
+	}
+	lv.app.metrics.request(lv)
+
+	if lv.span != nil {
+		lv.span.Set(Kv{"http.status_code": status})
+		// the logs are filtered in place down below
+		lv.mu.Lock()
+		lv.span.Logs = append([]Log(nil), lv.Logs...)
+		lv.mu.Unlock()
+		lv.span.End(err)
+	}
+
+	if lv.filter() {
+		lv.app.logger.Report(lv)
+	}
+
+	lv.launch()
+}
+
+// waitJobs waits for the jobs for no longer than JobTimeout;
+// the stuck ones are cancelled, listed in a WARNING and left
+// behind, their logs from then on discarded.
+func (lv *Lv) waitJobs() {
+	timeout := lv.app.cfg.JobTimeout
+	if timeout <= 0 {
+		lv.wg.Wait()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if wait(ctx, &lv.wg) == nil {
+		return
+	}
+
+	lv.cancel()
+
+	lv.mu.Lock()
+	ids := make([]int, 0, len(lv.jobs))
+	for id := range lv.jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var (
+		stuck   []string
+		unnamed int
+	)
+	for _, id := range ids {
+		if name := lv.jobs[id]; name != "" {
+			stuck = append(stuck, name)
+		} else {
+			unnamed++
+		}
+	}
+	lv.mu.Unlock()
+
+	// the logs of Go jobs are untagged, so there's no
+	// telling them apart by any name
+	if unnamed != 0 {
+		stuck = append(stuck, fmt.Sprintf("%d unnamed", unnamed))
+	}
+
+	lv.Warnf("levi: gave up on %d stuck jobs after %s: %s",
+		len(ids), timeout, strings.Join(stuck, ", "))
+
+	lv.mu.Lock()
+	lv.abandoned = true
+	lv.mu.Unlock()
+}
+
+// Started is when the request came in.
+func (lv *Lv) Started() time.Time {
+	return lv.started
+}
+
+// Elapsed is how long it took to serve the request, jobs
+// included; it's only known once the request is finished.
+func (lv *Lv) Elapsed() time.Duration {
+	return lv.finished.Sub(lv.started)
+}
+
+// snapshot detaches the finished request from its echo context,
+// which echo recycles as soon as the handler returns.
+func (lv *Lv) snapshot() *Lv {
+	c := lv.app.router.NewContext(lv.Request(), nil)
+	res, orig := c.Response(), lv.Response()
+	res.Status, res.Size, res.Committed = orig.Status, orig.Size, orig.Committed
+
+	snap := &Lv{
+		Context:  c,
+		Pool:     lv.Pool,
+		app:      lv.app,
+		id:       lv.id,
+		trace:    lv.trace,
+		started:  lv.started,
+		finished: lv.finished,
+		detached: lv.detached,
+	}
+
+	lv.mu.Lock()
+	snap.Logs = append([]Log(nil), lv.Logs...)
+	snap.Tag(lv.Fields)
+	lv.mu.Unlock()
+	return snap
+}
+
+// App is the application serving the request.
+func (lv *Lv) App() *App {
+	return lv.app
 }
 
 // Addr reports the most likely Addr of the remote host.
@@ -93,15 +284,15 @@ func (lv *Lv) Putcookie(name, value string, httpOnly ...bool) {
 	policy := http.SameSiteLaxMode
 	domain := "localhost"
 
-	if IsProd() {
+	if lv.app.IsProd() {
 		policy = http.SameSiteStrictMode
-		domain = serverDomain
+		domain = lv.app.cfg.Domain
 	}
 
 	lv.SetCookie(&http.Cookie{
 		Name:     name,
 		Value:    value,
-		Secure:   IsProd(),
+		Secure:   lv.app.IsProd(),
 		HttpOnly: len(httpOnly) == 1 && httpOnly[0],
 		SameSite: policy,
 		Domain:   domain,
@@ -113,38 +304,117 @@ func (lv *Lv) Putcookie(name, value string, httpOnly ...bool) {
 func (lv *Lv) Dropcookie(name string) {
 	lv.SetCookie(&http.Cookie{
 		Name:     name,
-		Secure:   IsProd(),
+		Secure:   lv.app.IsProd(),
 		HttpOnly: true,
 		MaxAge:   -1,
 	})
 }
 
+// Form is the paperwork: bound from the request, validated
+// by its validate tags (see Lv.Validate), then by Validate,
+// if it has one, and finally applied.
 type Form interface {
-	Validate(*Lv) error
 	Apply(*Lv) error
 }
 
-func (lv *Lv) Paperwork(form Form) error {
+// FormValidator is a Form that goes beyond the tags.
+type FormValidator interface {
+	Form
+	Validate(*Lv) error
+}
+
+// Paperwork binds, validates and applies the form.
+//
+// With atomic, Apply runs in a transaction, committed once it
+// succeeds and rolled back if it fails or panics; lv.Table,
+// lv.Tables, lv.Enqueue and lv.Atomic all go through it, see
+// Tx. Forms that need more control may use lv.Atomic instead.
+//
+// The transaction is not for the jobs to share: Go and GoNamed
+// panic with ErrAtomicJobs within the atomic Apply, and so
+// does the atomic paperwork fail with the jobs still running.
+func (lv *Lv) Paperwork(form Form, atomic ...bool) error {
 	if err := lv.Bind(form); err != nil {
-		lv.Error(err)
-		return ErrBadPaperwork
+		return fmt.Errorf("%w: %v", ErrBadPaperwork, err)
 	}
 
-	if e := form.Validate(lv); e != nil {
-		err, ok := e.(*ValidationError)
-		if !ok {
-			lv.Errorf("levi: when validating:", e)
+	if err := lv.Validate(form); err != nil {
+		return err
+	}
+
+	if v, ok := form.(FormValidator); ok {
+		if err := v.Validate(lv); err != nil {
+			return err
 		}
+	}
 
-		return lv.JSON(http.StatusUnprocessableEntity, err)
+	if len(atomic) == 1 && atomic[0] {
+		return lv.applyAtomic(form)
 	}
 
 	return form.Apply(lv)
 }
 
-// Atomic runs a postgres transaction.
-func (lv *Lv) Atomic(fn func(tx *pg.Tx) error) error {
-	return db.RunInTransaction(fn)
+func (lv *Lv) applyAtomic(form Form) (err error) {
+	lv.mu.Lock()
+	running := len(lv.jobs)
+	lv.mu.Unlock()
+	if running != 0 {
+		return fmt.Errorf("%w: %d running", ErrAtomicJobs, running)
+	}
+
+	started, committed := time.Now(), false
+	defer func() {
+		lv.setTx(nil)
+		if committed {
+			lv.Debugf("levi: paperwork committed in %s", time.Since(started))
+		} else {
+			lv.Warnf("levi: paperwork rolled back in %s", time.Since(started))
+		}
+	}()
+
+	err = lv.Atomic(func(tx *pg.Tx) error {
+		lv.setTx(tx)
+		return form.Apply(lv)
+	})
+	committed = err == nil
+	return err
+}
+
+// Tx is the transaction of the atomic paperwork being applied,
+// or nil.
+func (lv *Lv) Tx() *pg.Tx {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	return lv.tx
+}
+
+// refuseAtomic panics within the atomic paperwork, as the
+// jobs would outlive its transaction.
+func (lv *Lv) refuseAtomic(name string) {
+	if lv.Tx() != nil {
+		panic(fmt.Errorf("%w: %s", ErrAtomicJobs, strings.TrimSpace("go "+name)))
+	}
+}
+
+func (lv *Lv) setTx(tx *pg.Tx) {
+	lv.mu.Lock()
+	lv.tx = tx
+	lv.mu.Unlock()
+}
+
+// Atomic runs a postgres transaction; within the atomic
+// paperwork, it's the paperwork's transaction.
+func (lv *Lv) Atomic(fn func(tx *pg.Tx) error) (err error) {
+	if tx := lv.Tx(); tx != nil {
+		return fn(tx)
+	}
+
+	span := lv.span.Child("tx")
+	defer span.done(&err)
+
+	return lv.app.db.WithContext(withSpan(lv.Ctx(), span)).RunInTransaction(fn)
 }
 
 // Table builds a new postgres orm query.
@@ -152,12 +422,15 @@ func (lv *Lv) Atomic(fn func(tx *pg.Tx) error) error {
 // Full postgres instance is usually not needed within
 // the actual leviathan routes.
 func (lv *Lv) Table(model interface{}) *orm.Query {
-	return db.Model(model)
+	return lv.Tables(model)
 }
 
 // Tables is like lv.Migrant(), but for slices.
 func (lv *Lv) Tables(models ...interface{}) *orm.Query {
-	return db.Model(models...)
+	if tx := lv.Tx(); tx != nil {
+		return tx.ModelContext(tx.Context(), models...)
+	}
+	return lv.app.db.ModelContext(lv.Ctx(), models...)
 }
 
 // QueryInt64 works just like (*echo.Context).QueryInt, but with int64.
@@ -171,7 +444,7 @@ func (lv *Lv) TBA() error {
 }
 
 func (lv *Lv) inb4() {
-	if inb4 != nil {
+	if inb4 := lv.app.cfg.Inb4; inb4 != nil {
 		inb4(lv)
 	}
 }
@@ -180,6 +453,27 @@ func (lv *Lv) inb4() {
 // be easily marshalled into JSON>
 type Kv map[string]interface{}
 
+// String formats the pairs as key=value, sorted by key;
+// values that contain spaces or quotes are quoted.
+func (h Kv) String() string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(h))
+	for _, k := range keys {
+		v := fmt.Sprint(h[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		pairs = append(pairs, k+"="+v)
+	}
+
+	return strings.Join(pairs, " ")
+}
+
 // JSON returns the result of marshalling.
 //
 // By default, the output of this function is not pretty.
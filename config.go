@@ -0,0 +1,160 @@
+package levi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadEnv reads a .env file into the process environment.
+//
+// Variables that are already set are never overwritten, so
+// the real environment always takes precedence. By default,
+// the file is called ".env"; a missing file is not an error.
+// Wake only reads it in development.
+//
+//	# comment
+//	PORT=8080
+//	export DATABASE_URL="postgresql://user@localhost/db"
+//
+func LoadEnv(path ...string) error {
+	name := ".env"
+	if len(path) == 1 {
+		name = path[0]
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return fmt.Errorf("levi: %s:%d: expected KEY=VALUE", name, n)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// loadEnv fills the zero fields of the config from the
+// environment variables named in their os tags.
+//
+// Values set in code are left intact. Fields missing in the
+// environment fall back to their default tag; the required
+// ones without a default are all reported at once.
+func loadEnv(cfg *Config) error {
+	var missing, invalid []string
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("os")
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if !field.IsZero() {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+
+		value := os.Getenv(name)
+		if value == "" {
+			value = f.Tag.Get("default")
+		}
+
+		if value == "" {
+			for _, opt := range opts[1:] {
+				if opt == "required" {
+					missing = append(missing, name)
+				}
+			}
+			continue
+		}
+
+		if err := setField(field, value); err != nil {
+			invalid = append(invalid, name+": "+err.Error())
+		}
+	}
+
+	if missing != nil || invalid != nil {
+		return &ConfigError{missing, invalid}
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+
+	case field.Kind() >= reflect.Int && field.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
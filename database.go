@@ -2,7 +2,10 @@ package levi
 
 import (
 	"context"
+	"fmt"
 	"time"
+
+	"github.com/go-pg/pg"
 )
 
 // Table is a normal soft-deletable model.
@@ -27,7 +30,7 @@ type baseTable struct {
 	Id int64 `json:"-"`
 }
 
-func (baseTable) Model() Archetype    { return TABLE }
+func (baseTable) Type() Archetype     { return TABLE }
 func (baseTable) Version() int        { return 0 } // automatic migration
 func (baseTable) Up(*Migration) error { return nil }
 
@@ -53,3 +56,36 @@ func (m *timeTable) BeforeUpdate(ctx context.Context) (context.Context, error) {
 
 	return ctx, nil
 }
+
+// openDatabase connects to postgres and makes sure it's there,
+// retrying with a linear backoff while the database is starting.
+func openDatabase(cfg *Config) (*pg.DB, error) {
+	opt, err := pg.ParseURL(cfg.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("levi: bad database url: %w", err)
+	}
+
+	opt.ApplicationName = cfg.ApplicationName
+	opt.PoolSize = cfg.DatabasePoolSize
+	opt.DialTimeout = cfg.DatabaseTimeout
+	opt.PoolTimeout = cfg.DatabaseTimeout
+	opt.ReadTimeout = cfg.DatabaseQueryTimeout
+	opt.WriteTimeout = cfg.DatabaseQueryTimeout
+
+	conn := pg.Connect(opt)
+	for attempt := 1; ; attempt++ {
+		_, err = conn.Exec("SELECT 1")
+		if err == nil {
+			return conn, nil
+		}
+
+		if attempt >= cfg.DatabaseRetries {
+			conn.Close()
+			return nil, fmt.Errorf("levi: database unreachable after %d attempts: %w",
+				attempt, err)
+		}
+
+		fmt.Printf("DATABASE ATTEMPT %d FAILED: %v\n", attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
@@ -12,10 +12,10 @@ type route struct {
 	method, path, name string
 }
 
-func debugRoutes() {
+func (app *App) debugRoutes() {
 	var routes []route
 
-	for _, r := range router.Routes() {
+	for _, r := range app.router.Routes() {
 		if r.Name == "github.com/labstack/echo.glob..func1" {
 			continue
 		}
@@ -37,12 +37,12 @@ func debugRoutes() {
 	fmt.Println()
 }
 
-func debugModels() {
+func (app *App) debugModels() {
 	fmt.Printf("MODELS\n\n")
 
 	var tt []*orm.Table
 
-	for _, model := range tables {
+	for _, model := range app.tables {
 		tt = append(tt, orm.GetTable(reflect.TypeOf(model).Elem()))
 	}
 
@@ -63,5 +63,47 @@ func debugModels() {
 		fmt.Printf("%8s %s <%s%s>\n", "TABLE", t.FullName, t.TypeName, info)
 	}
 
+	for _, model := range app.cues {
+		fmt.Printf("%8s %s <%T>\n", "QUEUE", queueName(model), model)
+	}
+
+	for _, model := range app.graphs {
+		fmt.Printf("%8s %s <%T>\n", "GRAPH", model.(Vertex).Class(), model)
+	}
+
+	fmt.Println()
+}
+
+func debugMigrations(done []autoMigration) {
+	if len(done) == 0 {
+		return
+	}
+
+	fmt.Printf("AUTOMIGRATED\n\n")
+
+	for _, am := range done {
+		if am.Created {
+			fmt.Printf("%8s %s\n", "CREATED", am.Table)
+		}
+
+		for _, column := range am.Columns {
+			fmt.Printf("%8s %s.%s\n", "ADDED", am.Table, column)
+		}
+	}
+
+	fmt.Println()
+}
+
+func debugDrift(drifts []Drift) {
+	if len(drifts) == 0 {
+		return
+	}
+
+	fmt.Printf("DRIFT\n\n")
+
+	for _, d := range drifts {
+		fmt.Printf("%8s %s\n", "WARNING", d)
+	}
+
 	fmt.Println()
 }
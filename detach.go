@@ -0,0 +1,164 @@
+package levi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Detach runs the work once the response is out, apart from
+// the request, e.g. to send an email:
+//
+//	lv.Detach("welcome email", func(lv *levi.Lv) {
+//		if err := mail(user); err != nil {
+//			lv.Error(err)
+//		}
+//	})
+//
+// The work is given a detached Lv of its own: it carries the
+// request id, trace and fields, but neither the response nor
+// the cancellation of the request. Its logs are reported in
+// a separate block, once the work (and its own jobs) is done.
+// Panics are recovered, and Wake drains the detached work on
+// shutdown, same as the requests; once it's draining, the new
+// work is refused with an ERROR, see ErrShutdown.
+func (lv *Lv) Detach(name string, work func(*Lv)) {
+	lv.mu.Lock()
+	launched := lv.launched
+	if !launched {
+		lv.pending = append(lv.pending, pendingWork{name, work})
+	}
+	lv.mu.Unlock()
+
+	if launched {
+		lv.app.detach(lv, name, work)
+	}
+}
+
+// DetachWork is Detach for a queue model: if the app has its
+// queue, the job is enqueued right away and processed by the
+// workers, retries and all; if it doesn't, the job is worked
+// in-process, once and for all. A queue with no database to
+// enqueue into is ErrNoDatabase.
+func (lv *Lv) DetachWork(job Worker) error {
+	name := queueName(job)
+	if lv.app.hasQueue(name) {
+		if lv.app.db == nil {
+			return fmt.Errorf("%w: queue %s", ErrNoDatabase, name)
+		}
+		return lv.Enqueue(job)
+	}
+
+	lv.Detach(name, func(lv *Lv) {
+		if err := job.Work(&Job{Queue: name, Attempt: 1}); err != nil {
+			lv.Error(err)
+		}
+	})
+	return nil
+}
+
+type pendingWork struct {
+	name string
+	work func(*Lv)
+}
+
+// launch starts the work detached so far; from then on,
+// Detach starts it right away.
+func (lv *Lv) launch() {
+	if res := lv.Response(); res.Committed {
+		if flusher, ok := res.Writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	lv.mu.Lock()
+	lv.launched = true
+	pending := lv.pending
+	lv.pending = nil
+	lv.mu.Unlock()
+
+	for _, p := range pending {
+		lv.app.detach(lv, p.name, p.work)
+	}
+}
+
+func (app *App) detach(from *Lv, name string, work func(*Lv)) {
+	span := from.span.Child("detach " + name)
+	ctx := withSpan(withTrace(context.Background(), from.id, from.trace), span)
+	req := from.Request().WithContext(ctx)
+
+	lv := &Lv{
+		Context:  app.router.NewContext(req, nil),
+		app:      app,
+		id:       from.id,
+		trace:    from.trace,
+		span:     span,
+		detached: name,
+	}
+	from.mu.Lock()
+	lv.level, lv.sample = from.level, from.sample
+	lv.Tag(from.Fields)
+	from.mu.Unlock()
+	ctx, lv.cancel = context.WithCancel(ctx)
+	lv.SetRequest(req.WithContext(ctx))
+
+	app.mu.Lock()
+	if app.draining {
+		app.mu.Unlock()
+
+		lv.started = time.Now()
+		lv.Error(fmt.Errorf("%w: %s", ErrShutdown, name))
+		lv.settle()
+		return
+	}
+	app.drain.Add(1)
+	app.mu.Unlock()
+
+	go func() {
+		defer app.drain.Done()
+		defer lv.settle()
+
+		lv.started = time.Now()
+		work(lv)
+	}()
+}
+
+// settle is End for the detached work.
+func (lv *Lv) settle() {
+	if r := recover(); r != nil {
+		lv.app.metrics.panic()
+		lv.Panicf("%s\n%s", r, panicStack())
+	}
+
+	lv.waitJobs()
+	lv.cancel()
+	lv.finished = time.Now()
+
+	if lv.span != nil {
+		lv.mu.Lock()
+		lv.span.Logs = append([]Log(nil), lv.Logs...)
+		lv.mu.Unlock()
+
+		var err error
+		if lv.Worst() >= ERROR {
+			err = ErrDetachFail
+		}
+		lv.span.End(err)
+	}
+
+	if lv.filter() {
+		lv.app.logger.Report(lv)
+	}
+
+	lv.launch()
+}
+
+func (app *App) hasQueue(name string) bool {
+	for _, model := range app.cues {
+		if queueName(model) == name {
+			return true
+		}
+	}
+	return false
+}
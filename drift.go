@@ -0,0 +1,228 @@
+package levi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// DriftKind tells what's wrong between the model and its table.
+type DriftKind int
+
+const (
+	MissingTable DriftKind = iota
+	MissingColumn
+	ExtraColumn
+	TypeMismatch
+	NullMismatch
+	DefaultMismatch
+	MissingIndex
+)
+
+func (k DriftKind) String() string {
+	switch k {
+	case MissingTable:
+		return "missing table"
+	case MissingColumn:
+		return "missing column"
+	case ExtraColumn:
+		return "extra column"
+	case TypeMismatch:
+		return "type mismatch"
+	case NullMismatch:
+		return "nullability mismatch"
+	case DefaultMismatch:
+		return "default mismatch"
+	case MissingIndex:
+		return "missing unique index"
+	default:
+		panic("levi: unknown drift kind")
+	}
+}
+
+// Drift is a single discrepancy between the Go model and
+// the live postgres schema. Want is what the model declares,
+// Have is what the database has got.
+type Drift struct {
+	Table  string
+	Column string
+	Kind   DriftKind
+	Want   string
+	Have   string
+}
+
+func (d Drift) String() string {
+	s := d.Kind.String() + " " + d.Table
+	if d.Column != "" {
+		s += "." + d.Column
+	}
+	if d.Want != "" || d.Have != "" {
+		s += fmt.Sprintf(" (want %q, have %q)", d.Want, d.Have)
+	}
+	return s
+}
+
+type liveColumn struct {
+	Name    string
+	Type    string
+	NotNull bool
+	Default string
+}
+
+// Drift compares every registered table model against the
+// live schema, as seen by pg_catalog.
+func (app *App) Drift() ([]Drift, error) {
+	var drifts []Drift
+	for _, model := range app.tables {
+		d, err := tableDrift(app.db, model)
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d...)
+	}
+
+	return drifts, nil
+}
+
+func tableDrift(db *pg.DB, model Model) ([]Drift, error) {
+	table := tableOf(model)
+	name := tableName(model)
+
+	var columns []liveColumn
+	_, err := db.Query(&columns, `SELECT a.attname AS name,
+	format_type(a.atttypid, a.atttypmod) AS type,
+	a.attnotnull AS not_null,
+	coalesce(pg_get_expr(d.adbin, d.adrelid), '') AS default
+FROM pg_attribute a
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE a.attrelid = to_regclass(?) AND a.attnum > 0 AND NOT a.attisdropped`,
+		string(table.FullName))
+	if err != nil {
+		return nil, fmt.Errorf("levi: failure to introspect %s: %w", name, err)
+	}
+
+	if len(columns) == 0 {
+		return []Drift{{Table: name, Kind: MissingTable}}, nil
+	}
+
+	var unique []string
+	_, err = db.Query(&unique, `SELECT a.attname
+FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+WHERE i.indrelid = to_regclass(?) AND i.indisunique AND i.indnatts = 1`,
+		string(table.FullName))
+	if err != nil {
+		return nil, fmt.Errorf("levi: failure to introspect %s: %w", name, err)
+	}
+
+	return diffTable(table, name, columns, unique), nil
+}
+
+func diffTable(table *orm.Table, name string, columns []liveColumn, unique []string) []Drift {
+	var drifts []Drift
+
+	live := map[string]liveColumn{}
+	for _, c := range columns {
+		live[c.Name] = c
+	}
+
+	indexed := map[string]bool{}
+	for _, c := range unique {
+		indexed[c] = true
+	}
+
+	declared := map[string]bool{}
+	for _, field := range table.Fields {
+		declared[field.SQLName] = true
+
+		c, ok := live[field.SQLName]
+		if !ok {
+			drifts = append(drifts, Drift{name, field.SQLName, MissingColumn, field.SQLType, ""})
+			continue
+		}
+
+		if want := sqlType(field.SQLType); want != c.Type {
+			drifts = append(drifts, Drift{name, field.SQLName, TypeMismatch, want, c.Type})
+		}
+
+		notNull := field.HasFlag(orm.NotNullFlag) || field.HasFlag(orm.PrimaryKeyFlag)
+		if notNull != c.NotNull {
+			drifts = append(drifts, Drift{name, field.SQLName, NullMismatch,
+				nullability(notNull), nullability(c.NotNull)})
+		}
+
+		serial := strings.HasPrefix(c.Default, "nextval(")
+		if want := string(field.Default); !serial && sqlDefault(want) != sqlDefault(c.Default) {
+			drifts = append(drifts, Drift{name, field.SQLName, DefaultMismatch, want, c.Default})
+		}
+
+		if field.HasFlag(orm.UniqueFlag) && !indexed[field.SQLName] {
+			drifts = append(drifts, Drift{Table: name, Column: field.SQLName, Kind: MissingIndex})
+		}
+	}
+
+	for _, c := range columns {
+		if !declared[c.Name] {
+			drifts = append(drifts, Drift{name, c.Name, ExtraColumn, "", c.Type})
+		}
+	}
+
+	return drifts
+}
+
+func nullability(notNull bool) string {
+	if notNull {
+		return "NOT NULL"
+	}
+	return "NULL"
+}
+
+// sqlAliases maps go-pg types onto what format_type() reports.
+var sqlAliases = map[string]string{
+	"bigserial":   "bigint",
+	"serial":      "integer",
+	"smallserial": "smallint",
+	"int":         "integer",
+	"int2":        "smallint",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"float4":      "real",
+	"float8":      "double precision",
+	"bool":        "boolean",
+	"decimal":     "numeric",
+	"varchar":     "character varying",
+	"char":        "character",
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+	"timetz":      "time with time zone",
+	"time":        "time without time zone",
+}
+
+// sqlType normalizes a declared type, e.g. "varchar(8)[]"
+// becomes "character varying(8)[]".
+func sqlType(declared string) string {
+	t := strings.ToLower(strings.TrimSpace(declared))
+
+	suffix := ""
+	if i := strings.IndexAny(t, "(["); i >= 0 {
+		t, suffix = t[:i], t[i:]
+	}
+
+	if alias, ok := sqlAliases[t]; ok {
+		t = alias
+	}
+
+	return t + suffix
+}
+
+var casts = regexp.MustCompile(`::[a-z ]+(\[\])?`)
+
+// sqlDefault strips casts and parens off a default expression,
+// the way postgres reformats them anyway.
+func sqlDefault(expr string) string {
+	expr = casts.ReplaceAllString(strings.ToLower(expr), "")
+	return strings.Trim(expr, "() ")
+}
@@ -3,27 +3,87 @@ package levi
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
 	ø = func(err string) error { return errors.New("levi: " + err) }
 
+	ErrNoDomain      = ø("server domain must be set before wake")
 	ErrNilModel      = ø("nil model interface")
 	ErrMigrationFail = ø("migration failed")
 	ErrBadArchetype  = ø("archetype not supported")
 	ErrBadPaperwork  = ø("paperwork bind fail")
 	ErrTmplRepeated  = ø("template loaded repeatedly")
+	ErrNotWorker     = ø("queue model must implement Worker")
+	ErrNotVertex     = ø("graph model must implement Vertex")
+	ErrDupClass      = ø("graph class registered twice")
+	ErrNotDemigrant  = ø("table model must implement Demigrant")
+	ErrBadCommand    = ø("bad migrate command")
+	ErrBadLogLevel   = ø("unknown log level")
+	ErrDetachFail    = ø("detached work failed")
+	ErrShutdown      = ø("work refused on shutdown")
+	ErrNoDatabase    = ø("database is not open")
+	ErrBadRule       = ø("bad validation rule")
+	ErrAtomicJobs    = ø("jobs within atomic paperwork")
 )
 
 // ValidationError should commonly be used in forms.
+//
+// It can carry a single failure, or all of them in Errors,
+// the first one being repeated in Field and Message:
+//
+//	{"ok": false, "field": "login", "message": "login is required",
+//	 "errors": [{"field": "login", "rule": "required", ...}, ...]}
+//
 type ValidationError struct {
-	OK      bool   `json:"ok"`
-	Field   string `json:"field,omitempty"`
+	OK      bool         `json:"ok"`
+	Field   string       `json:"field,omitempty"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a single validation failure.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
 	Message string `json:"message"`
 }
 
 func (err *ValidationError) Error() string {
-	return fmt.Sprintf("levi: validation error: %s (field %s)", err.Message, err.Field)
+	msg := fmt.Sprintf("levi: validation error: %s (field %s)", err.Message, err.Field)
+	if n := len(err.Errors); n > 1 {
+		msg += fmt.Sprintf(" and %d more", n-1)
+	}
+	return msg
+}
+
+// ConfigError lists every environment variable that is either
+// required but missing, or failed to parse.
+type ConfigError struct {
+	Missing []string
+	Invalid []string
+}
+
+func (err *ConfigError) Error() string {
+	var problems []string
+	if len(err.Missing) != 0 {
+		problems = append(problems, "missing "+strings.Join(err.Missing, ", "))
+	}
+	if len(err.Invalid) != 0 {
+		problems = append(problems, "invalid "+strings.Join(err.Invalid, "; "))
+	}
+	return "levi: bad environment: " + strings.Join(problems, "; ")
+}
+
+// DriftError occurs when the models don't match the live schema.
+type DriftError struct {
+	Drifts []Drift
+}
+
+func (err *DriftError) Error() string {
+	return fmt.Sprintf("levi: schema drifted in %d places, first: %s",
+		len(err.Drifts), err.Drifts[0])
 }
 
 // MigrationError occurs whenever the table migration fails.
@@ -44,3 +104,23 @@ func (err *MigrationError) Error() string {
 func (err *MigrationError) Unwrap() error {
 	return err.Err
 }
+
+// JobError lists the failed jobs of a Group, in the order
+// they failed.
+type JobError struct {
+	Jobs []string
+	Errs []error
+}
+
+func (err *JobError) Error() string {
+	failures := make([]string, len(err.Jobs))
+	for i, job := range err.Jobs {
+		failures[i] = fmt.Sprintf("%s: %v", job, err.Errs[i])
+	}
+	return fmt.Sprintf("levi: %d jobs failed: %s", len(err.Jobs), strings.Join(failures, "; "))
+}
+
+// Unwrap is the first failure, the one that cancelled the rest.
+func (err *JobError) Unwrap() error {
+	return err.Errs[0]
+}
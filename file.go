@@ -0,0 +1,383 @@
+package levi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileLogger writes the human-readable request logs, grouped
+// the same way as StdLogger does, into a file; it rotates the
+// file by size and age, gzips the rotated segments and keeps
+// only so many of them.
+//
+// The file is reopened on SIGHUP, to play along with logrotate.
+type FileLogger struct {
+	// Path to the log file, e.g. "log/levi.log".
+	Path string
+
+	// Rotate once the file grows bigger, in bytes.
+	//
+	// Default: 100 MiB; negative disables.
+	MaxSize int64
+
+	// Rotate once the file is older.
+	//
+	// Default: 24 hours; negative disables.
+	MaxAge time.Duration
+
+	// The number of rotated segments to keep, the oldest
+	// get deleted first.
+	//
+	// Default: 7; negative keeps everything.
+	Keep int
+
+	// Keeps the rotated segments as they are, no gzip.
+	NoCompress bool
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	once   sync.Once
+	hup    chan os.Signal
+
+	// the rotated segments being compressed, and the
+	// failure in the background, kept for Flush
+	idle        *sync.Cond
+	compressing int
+	failed      error
+
+	// one segment is compressed and pruned at a time
+	segments sync.Mutex
+}
+
+func (f *FileLogger) init() {
+	if f.MaxSize == 0 {
+		f.MaxSize = 100 << 20
+	}
+	if f.MaxAge == 0 {
+		f.MaxAge = 24 * time.Hour
+	}
+	if f.Keep == 0 {
+		f.Keep = 7
+	}
+
+	f.idle = sync.NewCond(&f.mu)
+	f.hup = make(chan os.Signal, 1)
+	signal.Notify(f.hup, syscall.SIGHUP)
+	go func(hup chan os.Signal) {
+		for range hup {
+			if err := f.Reopen(); err != nil {
+				f.fail(err)
+			}
+		}
+	}(f.hup)
+}
+
+func (f *FileLogger) Report(lv *Lv) error {
+	f.once.Do(f.init)
+
+	var b bytes.Buffer
+	writeReport(&b, lv)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if f.due(int64(b.Len())) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := b.WriteTo(f.file)
+	f.size += n
+	return err
+}
+
+// Reopen closes and reopens the file, e.g. after it was
+// moved away by an external tool.
+func (f *FileLogger) Reopen() error {
+	f.once.Do(f.init)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	return f.open()
+}
+
+// Flush syncs the file to disk and waits for the compression
+// of the rotated segments to finish; it returns the failure
+// in the background, if any, since the last Flush.
+func (f *FileLogger) Flush() error {
+	f.once.Do(f.init)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var err error
+	if f.file != nil {
+		err = f.file.Sync()
+	}
+
+	for f.compressing > 0 {
+		f.idle.Wait()
+	}
+	if err == nil {
+		err = f.failed
+	}
+	f.failed = nil
+	return err
+}
+
+// Close stops listening to SIGHUP, waits for the compression
+// and closes the file. Wake calls it on shutdown.
+func (f *FileLogger) Close() error {
+	f.once.Do(f.init)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.hup != nil {
+		signal.Stop(f.hup)
+		close(f.hup)
+		f.hup = nil
+	}
+
+	for f.compressing > 0 {
+		f.idle.Wait()
+	}
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *FileLogger) fail(err error) {
+	f.mu.Lock()
+	if f.failed == nil {
+		f.failed = err
+	}
+	f.mu.Unlock()
+}
+
+// open opens the file, along with its creation time, which
+// is kept next to it, in levi.log.created, since neither
+// the modification time nor the file system would do.
+func (f *FileLogger) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	created, err := f.created(info.Size() == 0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), created
+	return nil
+}
+
+// created reads the creation time of the file, or records
+// it as now, if the file is fresh, or the time is unknown.
+func (f *FileLogger) created(fresh bool) (time.Time, error) {
+	path := f.Path + ".created"
+
+	if !fresh {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+			if err == nil {
+				return t, nil
+			}
+		}
+	}
+
+	now := time.Now()
+	err := ioutil.WriteFile(path, []byte(now.Format(time.RFC3339Nano)+"\n"), 0644)
+	return now, err
+}
+
+func (f *FileLogger) due(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.MaxSize > 0 && f.size+n > f.MaxSize {
+		return true
+	}
+	return f.MaxAge > 0 && time.Since(f.opened) > f.MaxAge
+}
+
+// segmentTime is the timestamp of the rotated segments.
+const segmentTime = "20060102-150405.000"
+
+// rotate moves the current file aside, as in levi.log becomes
+// levi.log.20200612-150405.000, or levi.log.20200612-150405.000-001
+// if rotated twice within a millisecond, and opens a fresh one.
+func (f *FileLogger) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	segment := f.segment(time.Now())
+	if err := os.Rename(f.Path, segment); err != nil {
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.compressing++
+	go func() {
+		defer func() {
+			f.mu.Lock()
+			if f.compressing--; f.compressing == 0 {
+				f.idle.Broadcast()
+			}
+			f.mu.Unlock()
+		}()
+
+		f.segments.Lock()
+		defer f.segments.Unlock()
+
+		if !f.NoCompress {
+			if err := gzipFile(segment); err != nil {
+				f.fail(err)
+			}
+		}
+
+		if err := f.prune(); err != nil {
+			f.fail(err)
+		}
+	}()
+
+	return nil
+}
+
+// segment names the next segment, so that it would neither
+// overwrite an older one, nor its gzip.
+func (f *FileLogger) segment(now time.Time) string {
+	base := f.Path + "." + now.Format(segmentTime)
+
+	segment := base
+	for seq := 1; ; seq++ {
+		_, err := os.Stat(segment)
+		_, gzerr := os.Stat(segment + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzerr) {
+			return segment
+		}
+		segment = fmt.Sprintf("%s-%03d", base, seq)
+	}
+}
+
+// prune deletes the oldest segments beyond Keep; a segment
+// is counted once, whether it's gzipped or not, or both.
+func (f *FileLogger) prune() error {
+	if f.Keep < 0 {
+		return nil
+	}
+
+	dir, name := filepath.Split(f.Path)
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(name) +
+		`\.\d{8}-\d{6}\.\d{3}(-\d{3,})?(\.gz)?$`)
+
+	files, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	paths := map[string][]string{}
+	for _, file := range files {
+		if pattern.MatchString(file.Name()) {
+			segment := strings.TrimSuffix(file.Name(), ".gz")
+			paths[segment] = append(paths[segment], filepath.Join(dir, file.Name()))
+		}
+	}
+
+	// timestamps sort lexicographically, and so do the
+	// sequence numbers of the same millisecond
+	segments := make([]string, 0, len(paths))
+	for segment := range paths {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+
+	for len(segments) > f.Keep {
+		for _, path := range paths[segments[0]] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		segments = segments[1:]
+	}
+
+	return nil
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := os.Rename(out.Name(), path+".gz"); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
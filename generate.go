@@ -0,0 +1,321 @@
+package levi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Migration scripts and snapshots live in the migrations
+// directory, one subdirectory per table:
+//
+//	migrations/users/snapshot.json
+//	migrations/users/0003.up.sql
+//	migrations/users/0003.down.sql
+//
+// Scripts are run by the migration engine right after the
+// model's own Up (and right before its Down.)
+
+// snapshot is the last known shape of the model's table.
+type snapshot struct {
+	Version int          `json:"version"`
+	Columns []snapColumn `json:"columns"`
+}
+
+type snapColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NotNull    bool   `json:"notnull,omitempty"`
+	Default    string `json:"default,omitempty"`
+	Unique     bool   `json:"unique,omitempty"`
+	SoftDelete bool   `json:"soft_delete,omitempty"`
+}
+
+func snapshotOf(table *orm.Table) []snapColumn {
+	columns := make([]snapColumn, 0, len(table.Fields))
+	for _, field := range table.Fields {
+		columns = append(columns, snapColumn{
+			Name:       field.SQLName,
+			Type:       field.SQLType,
+			NotNull:    field.HasFlag(orm.NotNullFlag) || field.HasFlag(orm.PrimaryKeyFlag),
+			Default:    string(field.Default),
+			Unique:     field.HasFlag(orm.UniqueFlag),
+			SoftDelete: field == table.SoftDeleteField,
+		})
+	}
+	return columns
+}
+
+// Generate compares the table model against its last snapshot
+// and emits the next versioned migration, either as a .sql
+// pair the engine loads, or as a Go `if v(N) {}` stub printed
+// out for the model's Up. format is either "sql" or "go".
+//
+// The first run only records the snapshot. Either way, the
+// model's Version() has to be bumped by hand.
+func (app *App) Generate(table, format string) error {
+	var model Model
+	for _, m := range app.tables {
+		if tableName(m) == table {
+			model = m
+		}
+	}
+	if model == nil {
+		return fmt.Errorf("%w: unknown table %s", ErrBadCommand, table)
+	}
+
+	dir := filepath.Join(app.cfg.MigrationsDir, table)
+	path := filepath.Join(dir, "snapshot.json")
+
+	var old snapshot
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		old.Version = -1
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &old); err != nil {
+			return fmt.Errorf("levi: bad snapshot %s: %w", path, err)
+		}
+	}
+
+	latest := 0
+	if migrant, ok := model.(Migrant); ok {
+		latest = migrant.Version()
+	}
+
+	current := snapshot{Version: latest, Columns: snapshotOf(tableOf(model))}
+	if old.Version < 0 {
+		fmt.Printf("SNAPSHOT %s v%d RECORDED\n", table, current.Version)
+		return writeSnapshot(dir, path, current)
+	}
+
+	if old.Version > current.Version {
+		current.Version = old.Version
+	}
+	current.Version++
+
+	up, down := diffSnapshots(string(tableOf(model).FullName), old.Columns, current.Columns)
+	if len(up) == 0 {
+		fmt.Printf("SNAPSHOT %s UP TO DATE\n", table)
+		return nil
+	}
+
+	switch format {
+	case "sql":
+		name := filepath.Join(dir, fmt.Sprintf("%04d", current.Version))
+		err := ioutil.WriteFile(name+".up.sql", []byte(strings.Join(up, "\n")+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(name+".down.sql", []byte(strings.Join(down, "\n")+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("GENERATED %s.up.sql %s.down.sql\n", name, name)
+
+	case "go":
+		fmt.Printf("\tif v(%d) {\n", current.Version)
+		for _, stmt := range up {
+			if strings.HasPrefix(stmt, "--") {
+				fmt.Printf("\t\t// %s\n", strings.TrimPrefix(stmt, "-- "))
+				continue
+			}
+			fmt.Printf("\t\tif _, err := mi.Exec(%q); err != nil {\n\t\t\treturn err\n\t\t}\n",
+				strings.TrimSuffix(stmt, ";"))
+		}
+		fmt.Printf("\t}\n")
+
+	default:
+		return fmt.Errorf("%w: bad format %s", ErrBadCommand, format)
+	}
+
+	fmt.Printf("BUMP %s Version() TO %d\n", table, current.Version)
+	return writeSnapshot(dir, path, current)
+}
+
+func writeSnapshot(dir, path string, snap snapshot) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// diffSnapshots returns the up and down statements, turning
+// the old columns into the new ones; comments are hints.
+func diffSnapshots(table string, old, cur []snapColumn) (up, down []string) {
+	was := map[string]snapColumn{}
+	for _, c := range old {
+		was[c.Name] = c
+	}
+	is := map[string]snapColumn{}
+	for _, c := range cur {
+		is[c.Name] = c
+	}
+
+	alter := "ALTER TABLE " + table + " "
+	var added, dropped []snapColumn
+
+	for _, c := range cur {
+		o, ok := was[c.Name]
+		if !ok {
+			added = append(added, c)
+			continue
+		}
+
+		col := quoteIdent(c.Name)
+		if c.Type != o.Type {
+			up = append(up, fmt.Sprintf("%sALTER COLUMN %s TYPE %s USING %s::%s;",
+				alter, col, c.Type, col, c.Type))
+			down = append(down, fmt.Sprintf("%sALTER COLUMN %s TYPE %s USING %s::%s;",
+				alter, col, o.Type, col, o.Type))
+		}
+		if c.NotNull != o.NotNull {
+			up = append(up, alter+"ALTER COLUMN "+col+setNotNull(c.NotNull))
+			down = append(down, alter+"ALTER COLUMN "+col+setNotNull(o.NotNull))
+		}
+		if c.Default != o.Default {
+			up = append(up, alter+"ALTER COLUMN "+col+setDefault(c.Default))
+			down = append(down, alter+"ALTER COLUMN "+col+setDefault(o.Default))
+		}
+		if c.Unique != o.Unique {
+			create, drop := uniqueIndex(table, c.Name)
+			if c.Unique {
+				up, down = append(up, create), append(down, drop)
+			} else {
+				up, down = append(up, drop), append(down, create)
+			}
+		}
+	}
+
+	for _, c := range old {
+		if _, ok := is[c.Name]; !ok {
+			dropped = append(dropped, c)
+		}
+	}
+
+	for _, c := range dropped {
+		for _, a := range added {
+			if a.Type == c.Type {
+				up = append(up, fmt.Sprintf("-- hint: %s may have been renamed to %s: %sRENAME COLUMN %s TO %s;",
+					c.Name, a.Name, alter, quoteIdent(c.Name), quoteIdent(a.Name)))
+			}
+		}
+	}
+
+	for _, c := range added {
+		if c.SoftDelete {
+			up = append(up, "-- soft delete column")
+		}
+		up = append(up, alter+"ADD COLUMN "+columnDef(c)+";")
+		down = append(down, alter+"DROP COLUMN "+quoteIdent(c.Name)+";")
+		if c.Unique {
+			create, _ := uniqueIndex(table, c.Name)
+			up = append(up, create)
+		}
+	}
+
+	for _, c := range dropped {
+		up = append(up, alter+"DROP COLUMN "+quoteIdent(c.Name)+";")
+		down = append(down, alter+"ADD COLUMN "+columnDef(c)+";")
+		if c.Unique {
+			create, _ := uniqueIndex(table, c.Name)
+			down = append(down, create)
+		}
+	}
+
+	// down statements undo the up ones in reverse
+	for i, j := 0, len(down)-1; i < j; i, j = i+1, j-1 {
+		down[i], down[j] = down[j], down[i]
+	}
+
+	return up, down
+}
+
+func columnDef(c snapColumn) string {
+	def := quoteIdent(c.Name) + " " + c.Type
+	if c.Default != "" {
+		def += " DEFAULT " + c.Default
+	}
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+func setNotNull(notNull bool) string {
+	if notNull {
+		return " SET NOT NULL;"
+	}
+	return " DROP NOT NULL;"
+}
+
+func setDefault(expr string) string {
+	if expr == "" {
+		return " DROP DEFAULT;"
+	}
+	return " SET DEFAULT " + expr + ";"
+}
+
+func uniqueIndex(table, column string) (create, drop string) {
+	// the index lives in the schema of its table
+	parts := splitIdent(table)
+	name := quoteIdent(parts[len(parts)-1] + "_" + column + "_key")
+	create = fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s);",
+		name, table, quoteIdent(column))
+	if len(parts) > 1 {
+		name = quoteIdent(parts[len(parts)-2]) + "." + name
+	}
+	drop = "DROP INDEX IF EXISTS " + name + ";"
+	return
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// runScript runs the up or down migration script of the table
+// for the version, if there is one.
+func (app *App) runScript(tx *pg.Tx, table string, version int, kind string) error {
+	path := app.scriptPath(table, version, kind)
+	script, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(string(script)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// hasDownScripts reports whether the table has any of the down
+// scripts between the versions.
+func (app *App) hasDownScripts(table string, from, to int) bool {
+	for v := from; v > to; v-- {
+		if _, err := os.Stat(app.scriptPath(table, v, "down")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) scriptPath(table string, version int, kind string) string {
+	return filepath.Join(app.cfg.MigrationsDir, table, fmt.Sprintf("%04d.%s.sql", version, kind))
+}
@@ -2,18 +2,52 @@ package levi
 
 import (
 	"crypto/rand"
+	"fmt"
 	"io"
+	"reflect"
+	"sync"
 
+	"github.com/cayleygraph/cayley/clog"
 	"github.com/cayleygraph/cayley/graph"
 	"github.com/cayleygraph/cayley/graph/path"
+	"github.com/cayleygraph/cayley/graph/sql/postgres"
 	"github.com/cayleygraph/cayley/schema"
 	"github.com/cayleygraph/cayley/voc/rdf"
 	"github.com/cayleygraph/quad"
+
+	_ "github.com/cayleygraph/cayley/writer"
 )
 
+// Graph is the cayley quadstore, living in the same postgres
+// database as the tables (see nodes and quads tables.)
 type Graph struct {
 	graph.Handle
 	sch *schema.Config
+
+	// the request span, see Lv.Graph
+	span *Span
+}
+
+// Node is the base of every GRAPH model.
+//
+// Graph models are regular cayley schema structs:
+//
+//	type Knol struct {
+//		levi.Node
+//		ID    quad.IRI `quad:"@id"`
+//		Title string   `quad:"tas:title"`
+//	}
+//
+//	func (Knol) Class() quad.IRI { return tas.Knol }
+//
+type Node struct{}
+
+func (Node) Type() Archetype { return GRAPH }
+
+// Vertex is a GRAPH model that knows its rdf:type.
+type Vertex interface {
+	Model
+	Class() quad.IRI
 }
 
 // ID generates a random quad.IRI for a given datatype,
@@ -60,15 +94,19 @@ func (g *Graph) Select(iri string) *path.Path {
 	return path.StartPath(g, quad.IRI(iri)).In(quad.IRI(rdf.Type))
 }
 
-func (g *Graph) Load(p *path.Path, dst interface{}) error {
+func (g *Graph) Load(p *path.Path, dst interface{}) (err error) {
+	defer g.span.Child("graph.load").done(&err)
 	return g.sch.LoadPathTo(nil, g, dst, p)
 }
 
-func (g *Graph) Get(dst interface{}, depth int, ids ...quad.Value) error {
+func (g *Graph) Get(dst interface{}, depth int, ids ...quad.Value) (err error) {
+	defer g.span.Child("graph.get").done(&err)
 	return g.sch.LoadToDepth(nil, g, dst, depth, ids...)
 }
 
-func (g *Graph) Put(it interface{}) (quad.Value, error) {
+func (g *Graph) Put(it interface{}) (_ quad.Value, err error) {
+	defer g.span.Child("graph.put").done(&err)
+
 	tx := graph.NewTransaction()
 
 	result, err := g.PutInto(tx, it)
@@ -101,14 +139,16 @@ func (g *Graph) PutInto(tx *graph.Transaction, values ...interface{}) ([]quad.Va
 	return result, nil
 }
 
-func (g *Graph) Delete(it interface{}) error {
+func (g *Graph) Delete(it interface{}) (err error) {
+	defer g.span.Child("graph.delete").done(&err)
+
 	tx := graph.NewTransaction()
 
 	if err := g.DeleteFrom(tx, it); err != nil {
 		return err
 	}
 
-	err := g.ApplyTransaction(tx)
+	err = g.ApplyTransaction(tx)
 	return err
 }
 
@@ -125,6 +165,92 @@ func (g *Graph) DeleteFrom(tx *graph.Transaction, values ...interface{}) error {
 	return nil
 }
 
+// Graph provides access to the application's quadstore.
+func (lv *Lv) Graph() *Graph {
+	if lv.span == nil || lv.app.quads == nil {
+		return lv.app.quads
+	}
+
+	g := *lv.app.quads
+	g.span = lv.span
+	return &g
+}
+
+// openGraph initialises the quadstore (if not already) and
+// registers every GRAPH model with the schema.
+func openGraph(url string, models []Model) (*Graph, error) {
+	clog.SetLogger(nologger{})
+
+	err := graph.InitQuadStore(postgres.Type, url, nil)
+	if err != nil && err != graph.ErrDatabaseExists {
+		return nil, fmt.Errorf("levi: failure to init quadstore: %w", err)
+	}
+
+	qs, err := graph.NewQuadStore(postgres.Type, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("levi: failure to open quadstore: %w", err)
+	}
+
+	qw, err := graph.NewQuadWriter("single", qs, graph.Options{
+		"ignore_duplicate": true,
+		"ignore_missing":   true,
+	})
+	if err != nil {
+		qs.Close()
+		return nil, fmt.Errorf("levi: failure to open quadwriter: %w", err)
+	}
+
+	// Cayley keeps the type registry global, so the types
+	// are visible to every schema.Config, including ours;
+	// it also panics on duplicates, hence the bookkeeping.
+	vertices.Lock()
+	for _, model := range models {
+		t := vertexType(model)
+		if !vertices.types[t] {
+			schema.RegisterType(model.(Vertex).Class(), t)
+			vertices.types[t] = true
+		}
+	}
+	vertices.Unlock()
+
+	return &Graph{Handle: graph.Handle{QuadStore: qs, QuadWriter: qw}, sch: newSchema()}, nil
+}
+
+// vertices are the types known to cayley, across the apps:
+// the classes claimed by Register, and the types registered.
+var vertices = struct {
+	sync.Mutex
+	classes map[quad.IRI]reflect.Type
+	types   map[reflect.Type]bool
+}{
+	classes: map[quad.IRI]reflect.Type{},
+	types:   map[reflect.Type]bool{},
+}
+
+// claimClass reserves the class IRI for the model's type;
+// cayley only takes a single type per class.
+func claimClass(v Vertex) error {
+	t, class := vertexType(v), v.Class().Full()
+
+	vertices.Lock()
+	defer vertices.Unlock()
+
+	if other, ok := vertices.classes[class]; ok && other != t {
+		return fmt.Errorf("%w: %s is both %s and %s", ErrDupClass, class, other, t)
+	}
+	vertices.classes[class] = t
+	return nil
+}
+
+// vertexType is the struct type, the way cayley sees it.
+func vertexType(model Model) reflect.Type {
+	t := reflect.TypeOf(model)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
 func newSchema() *schema.Config {
 	sch := schema.NewConfig()
 	sch.GenerateID = func(unknown interface{}) quad.Value {
@@ -0,0 +1,111 @@
+package levi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Group is a set of jobs working towards the same result,
+// in the spirit of errgroup:
+//
+//	g := lv.Group(4)
+//	for _, id := range ids {
+//		id := id
+//		g.Go("fetch "+id, func(ctx context.Context) error {
+//			return fetch(ctx, id)
+//		})
+//	}
+//	if err := g.Wait(); err != nil {
+//		return err
+//	}
+//
+// The jobs are Lv.Go jobs all the same: they are traced, the
+// request waits for them and so on.
+type Group struct {
+	lv     *Lv
+	ctx    context.Context
+	cancel context.CancelFunc
+	limit  chan struct{}
+
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err *JobError
+}
+
+// Group starts a new group of jobs; its context is derived
+// from the request's one, so the jobs get cancelled when the
+// client goes away or the RequestTimeout is reached, as well
+// as when any of the jobs fails.
+//
+// The optional limit is the number of jobs running at once;
+// Go blocks until there is room.
+func (lv *Lv) Group(limit ...int) *Group {
+	ctx, cancel := context.WithCancel(lv.Ctx())
+	g := &Group{lv: lv, ctx: ctx, cancel: cancel}
+	if len(limit) == 1 && limit[0] > 0 {
+		g.limit = make(chan struct{}, limit[0])
+	}
+
+	return g
+}
+
+// Go runs the job in the group; its error, as well as its
+// panic, is logged under its name and fails the group.
+func (g *Group) Go(name string, job func(ctx context.Context) error) {
+	// before taking the room, or Wait would never return
+	g.lv.refuseAtomic(name)
+
+	if g.limit != nil {
+		g.limit <- struct{}{}
+	}
+
+	g.wg.Add(1)
+	g.lv.spawn(name, func() {
+		defer func() {
+			if r := recover(); r != nil {
+				g.fail(name, fmt.Errorf("panic: %v", r))
+				g.done()
+				panic(r)
+			}
+			g.done()
+		}()
+
+		if err := job(g.ctx); err != nil {
+			(&Entry{lv: g.lv, job: name}).Error(err)
+			g.fail(name, err)
+		}
+	})
+}
+
+func (g *Group) done() {
+	if g.limit != nil {
+		<-g.limit
+	}
+	g.wg.Done()
+}
+
+func (g *Group) fail(name string, err error) {
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = &JobError{}
+		g.cancel()
+	}
+	g.err.Jobs = append(g.err.Jobs, name)
+	g.err.Errs = append(g.err.Errs, err)
+	g.mu.Unlock()
+}
+
+// Wait waits for the jobs to finish, and returns a JobError
+// listing the failed ones, if any.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.err == nil {
+		return nil
+	}
+	return g.err
+}
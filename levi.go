@@ -1,8 +1,16 @@
 package levi
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/labstack/echo"
@@ -16,11 +24,35 @@ const figurine = `
  |_____| |_____|    \_/    |___| /_/   \_\   |_|   |_| |_| /_/   \_\ |_| \_|
 `
 
+// Config is read from the environment by Wake, see the os tags.
+//
+// Fields that are set in code take precedence over the environment;
+// in development, variables can also be put into the .env file.
 type Config struct {
-	Port        string `os:"PORT"`         // no default
-	Production  string `os:"PRODUCTION"`   // no default
-	Domain      string `os:"DOMAIN"`       // ex: veritas.icu
-	DatabaseURL string `os:"DATABASE_URL"` // ex: postgresql://user@localhost/db
+	Port        string `os:"PORT,required"`         // no default
+	Production  bool   `os:"PRODUCTION"`            // default: false
+	Domain      string `os:"DOMAIN,required"`       // ex: veritas.icu
+	DatabaseURL string `os:"DATABASE_URL,required"` // ex: postgresql://user@localhost/db
+
+	// StrictSchema makes Wake refuse to start in production if
+	// the models have drifted away from the live schema.
+	StrictSchema bool `os:"STRICT_SCHEMA"`
+
+	// MigrationsDir holds the generated migration scripts and
+	// the model snapshots, see App.Generate.
+	MigrationsDir string `os:"MIGRATIONS_DIR" default:"migrations"`
+
+	// Postgres connection pool, see go-pg options for details.
+	ApplicationName  string        `os:"APPLICATION_NAME" default:"levi"`
+	DatabasePoolSize int           `os:"DATABASE_POOL_SIZE"`             // default: 10 per CPU
+	DatabaseTimeout  time.Duration `os:"DATABASE_TIMEOUT" default:"30s"` // dial & pool wait
+	DatabaseRetries  int           `os:"DATABASE_RETRIES" default:"5"`   // at startup
+
+	// The time a query may take to read or write, see go-pg
+	// ReadTimeout & WriteTimeout; the migrations are exempt.
+	//
+	// Default: none, see also RequestTimeout.
+	DatabaseQueryTimeout time.Duration `os:"DATABASE_QUERY_TIMEOUT"`
 
 	// Inb4 is guaranteed to execute before the request.
 	Inb4 func(*Lv)
@@ -31,110 +63,360 @@ type Config struct {
 	// This has an advantage of showing intricate deltas for granular
 	// sequential operations within a request.
 	//
-	// Default: 100 μs.
-	LogGroupWindow int `os:"LOG_GROUP_WINDOW"`
+	// Default: 100 μs; negative disables the grouping.
+	LogGroupWindow int `os:"LOG_GROUP_WINDOW" default:"100"`
+
+	// The least severe logs that are reported: debug, warning,
+	// error or panic; see also LogLevel for the per-route one.
+	//
+	// Default: debug in dev, warning in production.
+	LogLevel string `os:"LOG_LEVEL"`
+
+	// LogKeepFailed buffers the logs below the level and only
+	// reports them if the request ends up in an ERROR or PANIC.
+	LogKeepFailed bool `os:"LOG_KEEP_FAILED"`
+
+	// The share of successful requests that get reported, from
+	// 0 to 1; see also LogSample for the per-route one.
+	//
+	// Default: 1, i.e. every request.
+	LogSample float64 `os:"LOG_SAMPLE" default:"1"`
+
+	// The time given to the in-flight requests, their jobs and
+	// queue workers to finish once the shutdown is requested.
+	ShutdownTimeout time.Duration `os:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	// The deadline of every request context, see Lv.Ctx; the
+	// jobs and the queries get cancelled once it's passed.
+	//
+	// Default: none.
+	RequestTimeout time.Duration `os:"REQUEST_TIMEOUT"`
+
+	// The time Lv.End waits for the jobs once the handler
+	// has returned, before it gives up on the stuck ones.
+	//
+	// Default: 30 seconds; negative waits forever.
+	JobTimeout time.Duration `os:"JOB_TIMEOUT" default:"30s"`
+
+	// The OpenTelemetry collector the spans are exported to, as
+	// in http://localhost:4318; see OTLPTracer.
+	//
+	// Default: none, unless there is a Tracer, no spans recorded.
+	TraceEndpoint string `os:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+
+	// Metrics exposes GET /metrics in the Prometheus text format,
+	// on MetricsAddr, apart from the app's own routes, so that
+	// it is neither public nor in the request logs.
+	Metrics     bool   `os:"METRICS"`
+	MetricsAddr string `os:"METRICS_ADDR" default:"localhost:9090"`
 
 	Logger   Logger
 	Renderer Renderer
+	Tracer   Tracer
 }
 
-var (
-	// listen port
-	port string
+// App is a single leviathan application.
+//
+// It owns its router, database, models, renderer and logger,
+// so several apps can coexist in the same process, e.g. an
+// admin API and a public API on different ports. Most programs
+// only ever need the default app behind Wake, Register & Echo.
+type App struct {
+	cfg Config
+
 	// postgres
 	db *pg.DB
+	// cayley quadstore
+	quads *Graph
 	// web server
 	router *echo.Echo
-	// serverDomain (required) is used for cookies.
-	serverDomain string
-	// inb4 is executed for every request before the handler kicks in.
-	inb4 func(*Lv)
-	// prod indicates whether the app is in prod
-	prod bool
 	// renderer manages endpoint templates
 	renderer Renderer
 	// the logger backlog
 	logger Logger
+	// the least severe logs reported
+	level Logotype
+	// the spans exporter, if tracing
+	tracer Tracer
+	// runtime metrics, if enabled
+	metrics *metrics
+	// []MigrationState, as of the last migration
+	migrated atomic.Value
+	// custom error responses
+	mappers []ErrorMapper
+	// the detached work in progress, and whether it's being
+	// drained, no new work accepted
+	mu       sync.Mutex
+	drain    sync.WaitGroup
+	draining bool
 	// models
 	tables, cues, graphs []Model
-)
+}
+
+// std is the default app.
+var std = newApp()
+
+// New constructs an app from the config.
+//
+// See Wake for how the config is read from the environment.
+func New(cfg *Config) (*App, error) {
+	app := newApp()
+	if err := app.configure(cfg); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func newApp() *App {
+	app := &App{}
+	app.router = app.newRouter()
+	return app
+}
 
 // Here it all begins.
-func Wake(cfg *Config) {
-	if err := parseConfig(cfg); err != nil {
-		panic(err)
+//
+// Wake configures and wakes up the default app, see App.Wake.
+func Wake(cfg *Config) error {
+	if err := std.configure(cfg); err != nil {
+		return err
 	}
 
+	return std.Wake()
+}
+
+// Wake runs the app.
+//
+// Wake blocks until the server fails or the process receives
+// SIGINT or SIGTERM; in the latter case, it stops accepting new
+// connections and waits for the in-flight requests (including
+// their Lv.Go jobs), queue workers and detached work to finish,
+// for no longer than ShutdownTimeout.
+func (app *App) Wake() error {
 	// 0. Routine checks
-	if serverDomain == "" {
-		panic("levi: serverDomain global variable must be set before wake")
+	if app.cfg.Domain == "" {
+		return ErrNoDomain
 	}
 
 	// 1. Say hello.
 	fmt.Print(figurine)
 
+	conn, err := openDatabase(&app.cfg)
+	if err != nil {
+		return err
+	}
+	app.db = conn
+	defer app.db.Close()
+
+	if app.tracer != nil {
+		app.db.AddQueryHook(sqlSpans{})
+	}
+
 	// 2. Do migrations.
-	if err := migrateUp(); err != nil {
-		panic(err)
+	automigrated, err := app.autoMigrateAll()
+	if err != nil {
+		return err
+	}
+
+	if err := app.MigrateUp(); err != nil {
+		return err
 	}
 
-	debugModels()
+	drifts, err := app.Drift()
+	if err != nil {
+		return err
+	}
+
+	if err := app.createQueues(); err != nil {
+		return err
+	}
+
+	if len(app.graphs) != 0 {
+		g, err := openGraph(app.cfg.DatabaseURL, app.graphs)
+		if err != nil {
+			return err
+		}
+		app.quads = g
+		defer app.quads.Close()
+	}
+
+	app.debugModels()
+	debugMigrations(automigrated)
+	debugDrift(drifts)
+
+	if len(drifts) != 0 && app.IsProd() && app.cfg.StrictSchema {
+		return &DriftError{drifts}
+	}
+
+	quit := make(chan struct{})
+	var workers sync.WaitGroup
+	app.startQueues(quit, &workers)
 
 	// 3. Set up routing.
-	http.Handle("/", router)
-	debugRoutes()
+	server := &http.Server{Addr: ":" + app.cfg.Port, Handler: app.router}
+	app.debugRoutes()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
 	// 4. Listen.
-	fmt.Println("WOKE", ":"+port)
+	fmt.Println("WOKE", ":"+app.cfg.Port)
 	fmt.Println()
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		panic(err)
+
+	failed := make(chan error, 2)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	var metrics *http.Server
+	if app.metrics != nil {
+		metrics = app.listenMetrics(failed)
+		fmt.Println("METRICS", app.cfg.MetricsAddr)
+		fmt.Println()
+	}
+
+	select {
+	case err = <-failed:
+	case sig := <-signals:
+		fmt.Println("SLEEP", sig)
+		fmt.Println()
+	}
+
+	// 5. Drain.
+	ctx, cancel := context.WithTimeout(context.Background(), app.cfg.ShutdownTimeout)
+	defer cancel()
+
+	if e := server.Shutdown(ctx); e != nil && err == nil {
+		err = e
+	}
+	if metrics != nil {
+		if e := metrics.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	close(quit)
+	if e := wait(ctx, &workers); e != nil && err == nil {
+		err = e
+	}
+	app.mu.Lock()
+	app.draining = true
+	app.mu.Unlock()
+	if e := wait(ctx, &app.drain); e != nil && err == nil {
+		err = e
+	}
+
+	for _, sink := range []interface{}{app.logger, app.tracer} {
+		if e := closeLogger(sink); e != nil && err == nil {
+			err = e
+		}
 	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
 }
 
-func parseConfig(cfg *Config) error {
-	if cfg.Port != "" {
-		port = cfg.Port
+// wait is wg.Wait() that gives up once the context is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	if cfg.Production != "" {
-		prod = true
+func (app *App) configure(cfg *Config) error {
+	// a stray .env must never override the production config
+	if production, _ := strconv.ParseBool(os.Getenv("PRODUCTION")); !production && !cfg.Production {
+		if err := LoadEnv(); err != nil {
+			return err
+		}
 	}
 
-	if cfg.Domain != "" {
-		serverDomain = cfg.Domain
+	if err := loadEnv(cfg); err != nil {
+		return err
 	}
 
-	if cfg.Inb4 != nil {
-		inb4 = cfg.Inb4
+	app.cfg = *cfg
+
+	app.level = DEBUG
+	if app.IsProd() {
+		app.level = WARNING
+	}
+	if cfg.LogLevel != "" {
+		level, err := ParseLogotype(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+		app.level = level
 	}
 
 	if cfg.Logger != nil {
-		logger = cfg.Logger
+		app.logger = cfg.Logger
 	} else {
-		logger = &StdLogger{}
+		app.logger = &StdLogger{}
+	}
+
+	switch {
+	case cfg.Tracer != nil:
+		app.tracer = cfg.Tracer
+	case cfg.TraceEndpoint != "":
+		app.tracer = &OTLPTracer{
+			Endpoint: cfg.TraceEndpoint,
+			Service:  app.cfg.ApplicationName,
+		}
+	}
+
+	if cfg.Metrics && app.metrics == nil {
+		app.metrics = newMetrics()
 	}
 
 	if cfg.Renderer != nil {
-		renderer = cfg.Renderer
+		app.renderer = cfg.Renderer
 	} else {
-		renderer = &HtmlRenderer{}
+		app.renderer = &HtmlRenderer{}
 	}
 
-	if cfg.LogGroupWindow == 0 {
-
+	if r, ok := app.renderer.(*HtmlRenderer); ok {
+		r.reload = app.IsDev()
 	}
+	app.router.Renderer = app.renderer
 
 	return nil
 }
 
+// DB provides access to the app's postgres pool.
+func (app *App) DB() *pg.DB {
+	return app.db
+}
+
 // IsProd is true when the app is running in production.
-func IsProd() bool {
-	return prod
+func (app *App) IsProd() bool {
+	return app.cfg.Production
 }
 
 // IsDev is true when the app is run in dev environment.
+func (app *App) IsDev() bool {
+	return !app.cfg.Production
+}
+
+// IsProd is true when the default app is running in production.
+func IsProd() bool {
+	return std.IsProd()
+}
+
+// IsDev is true when the default app is run in dev environment.
 func IsDev() bool {
-	return !prod
+	return std.IsDev()
 }
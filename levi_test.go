@@ -1,7 +1,28 @@
 package levi
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cayleygraph/quad"
 	"github.com/go-pg/pg"
+	"github.com/labstack/echo"
 )
 
 type User struct {
@@ -14,20 +35,23 @@ type User struct {
 	LastName  string
 }
 
+var _ Demigrant = (*User)(nil)
+
+func (*User) Version() int { return 4 }
+
 func (*User) Up(mi *Migration) error {
 	v := mi.Up()
 
-	switch {
-	case v(1):
+	if v(1) {
 		// migrations for v1
-		fallthrough
-	case v(2):
+	}
+	if v(2) {
 		// migrations for v2
-		fallthrough
-	case v(3):
+	}
+	if v(3) {
 		// migrations for v3
-		fallthrough
-	case v(4):
+	}
+	if v(4) {
 		// migrations for v4
 	}
 
@@ -37,17 +61,16 @@ func (*User) Up(mi *Migration) error {
 func (*User) Down(mi *Migration) error {
 	v := mi.Down()
 
-	switch {
-	case v(4):
+	if v(4) {
 		// de-migration for v4
-		fallthrough
-	case v(3):
+	}
+	if v(3) {
 		// de-migration for v3
-		fallthrough
-	case v(2):
+	}
+	if v(2) {
 		// de-migration for v2
-		fallthrough
-	case v(1):
+	}
+	if v(1) {
 		// de-migration for v1
 	}
 
@@ -57,8 +80,8 @@ func (*User) Down(mi *Migration) error {
 func ExampleMigration() {
 	const oldVersion = 2
 
-	db.RunInTransaction(func(tx *pg.Tx) error {
-		mi := &Migration{Tx: tx, From: oldVersion}
+	std.DB().RunInTransaction(func(tx *pg.Tx) error {
+		mi := &Migration{Tx: tx, From: oldVersion, To: 4}
 
 		var model User
 		if err := model.Up(mi); err != nil {
@@ -68,3 +91,1602 @@ func ExampleMigration() {
 		return nil
 	})
 }
+
+// testDB connects to LEVI_TEST_DATABASE_URL; the tests that
+// need postgres are skipped without it.
+func testDB(t *testing.T) *pg.DB {
+	url := os.Getenv("LEVI_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("LEVI_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := openDatabase(&Config{DatabaseURL: url, DatabaseRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type flakyJob struct {
+	Queue
+	Fail int `json:"fail"` // the attempts that fail
+}
+
+func (j *flakyJob) Work(job *Job) error {
+	if job.Attempt <= j.Fail {
+		return fmt.Errorf("attempt %d", job.Attempt)
+	}
+	return nil
+}
+
+func (*flakyJob) Policy() QueuePolicy {
+	return QueuePolicy{MaxAttempts: 2, Backoff: func(int) time.Duration { return 0 }}
+}
+
+type barePolicyJob struct{}
+
+func (barePolicyJob) Type() Archetype { return QUEUE }
+func (barePolicyJob) Work(*Job) error { return nil }
+
+func TestQueuePolicy(t *testing.T) {
+	app := newApp()
+
+	q := newQueue(app, &barePolicyJob{})
+	if p := q.policy; p.Concurrency != 1 || p.MaxAttempts != 5 || p.Visibility != time.Minute {
+		t.Errorf("defaults: %+v", p)
+	}
+	if q.policy.Backoff(1) != time.Second || q.policy.Backoff(3) != 4*time.Second {
+		t.Errorf("backoff: %s, %s", q.policy.Backoff(1), q.policy.Backoff(3))
+	}
+	if q.policy.Backoff(100) != q.policy.Backoff(17) {
+		t.Errorf("unbounded backoff")
+	}
+
+	if q := newQueue(app, &flakyJob{}); q.policy.MaxAttempts != 2 || q.policy.Backoff(5) != 0 {
+		t.Errorf("policy: %+v", q.policy)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	var reports []*Lv
+
+	app := newApp()
+	app.db = testDB(t)
+	app.logger = reporter(func(lv *Lv) error {
+		reports = append(reports, lv)
+		return nil
+	})
+	app.cues = []Model{&flakyJob{}}
+
+	q := newQueue(app, &flakyJob{})
+	if _, err := app.db.Exec(`DROP TABLE IF EXISTS ?`, pg.F(q.name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.createQueues(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.db.Exec(`DROP TABLE ?`, pg.F(q.name)) })
+
+	// the first one succeeds on a retry, the second one dies
+	for _, job := range []*flakyJob{{Fail: 1}, {Fail: 2}} {
+		if err := Enqueue(app.db, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed := 0
+	for q.next() {
+		if claimed++; claimed > 10 {
+			t.Fatal("claimed forever")
+		}
+	}
+	if claimed != 4 {
+		t.Errorf("claimed %d times", claimed)
+	}
+
+	var left []struct {
+		Attempts int
+		Dead     bool
+		Error    string
+	}
+	_, err := app.db.Query(&left, `SELECT attempts, dead_at IS NOT NULL AS dead, error FROM ?`, pg.F(q.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Attempts != 2 || !left[0].Dead || left[0].Error != "attempt 2" {
+		t.Errorf("left: %+v", left)
+	}
+
+	var kinds []Logotype
+	for _, lv := range reports {
+		kinds = append(kinds, lv.Worst())
+	}
+	if !reflect.DeepEqual(kinds, []Logotype{WARNING, WARNING, ERROR}) {
+		t.Errorf("reported: %v", kinds)
+	}
+
+	// postponed by the backoff, the job is not claimed
+	q.policy.Backoff = func(int) time.Duration { return time.Hour }
+	if err := Enqueue(app.db, &flakyJob{Fail: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !q.next() || q.next() {
+		t.Errorf("claimed before the backoff")
+	}
+}
+
+type note struct {
+	tableName struct{} `sql:"levi_test_notes"`
+
+	ID   int
+	Text string
+}
+
+type noteForm struct {
+	Text string `json:"text"`
+	Then string `json:"then"` // "", "fail", "panic" or "go"
+}
+
+func (f *noteForm) Apply(lv *Lv) error {
+	if _, err := lv.Table(&note{Text: f.Text}).Insert(); err != nil {
+		return err
+	}
+	if err := lv.Enqueue(&flakyJob{}); err != nil {
+		return err
+	}
+
+	switch f.Then {
+	case "fail":
+		return errors.New("fail")
+	case "panic":
+		panic("panic")
+	case "go":
+		lv.Go(func() {})
+	}
+	return nil
+}
+
+func TestAtomicPaperwork(t *testing.T) {
+	app := newApp()
+	app.db = testDB(t)
+	app.cues = []Model{&flakyJob{}}
+
+	q := newQueue(app, &flakyJob{})
+	for _, table := range []string{"levi_test_notes", q.name} {
+		if _, err := app.db.Exec(`DROP TABLE IF EXISTS ?`, pg.F(table)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := app.db.Exec(`CREATE TABLE levi_test_notes (id serial PRIMARY KEY, text text)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.createQueues(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.db.Exec(`DROP TABLE levi_test_notes, ?`, pg.F(q.name)) })
+
+	apply := func(then string) (lv *Lv, raised interface{}, err error) {
+		body := fmt.Sprintf(`{"text": %q, "then": %q}`, then, then)
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		lv = &Lv{Context: app.router.NewContext(req, httptest.NewRecorder()), app: app}
+
+		defer func() { raised = recover() }()
+		return lv, nil, lv.Paperwork(&noteForm{}, true)
+	}
+	count := func() (notes, jobs int) {
+		notes, _ = app.db.Model((*note)(nil)).Count()
+		app.db.QueryOne(pg.Scan(&jobs), `SELECT count(*) FROM ?`, pg.F(q.name))
+		return
+	}
+
+	lv, _, err := apply("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes, jobs := count(); notes != 1 || jobs != 1 {
+		t.Errorf("committed %d notes, %d jobs", notes, jobs)
+	}
+	if last := lv.Logs[len(lv.Logs)-1]; last.How != DEBUG || !strings.Contains(string(last.What), "committed in") {
+		t.Errorf("got %s", last)
+	}
+	if lv.Tx() != nil {
+		t.Error("tx left behind")
+	}
+
+	lv, _, err = apply("fail")
+	if err == nil || err.Error() != "fail" {
+		t.Errorf("got %v", err)
+	}
+	if last := lv.Logs[len(lv.Logs)-1]; last.How != WARNING || !strings.Contains(string(last.What), "rolled back in") {
+		t.Errorf("got %s", last)
+	}
+
+	lv, raised, _ := apply("panic")
+	if raised != "panic" {
+		t.Errorf("raised %v", raised)
+	}
+	if last := lv.Logs[len(lv.Logs)-1]; last.How != WARNING || !strings.Contains(string(last.What), "rolled back in") {
+		t.Errorf("got %s", last)
+	}
+
+	_, raised, _ = apply("go")
+	if err, _ := raised.(error); !errors.Is(err, ErrAtomicJobs) {
+		t.Errorf("raised %v", raised)
+	}
+
+	if notes, jobs := count(); notes != 1 || jobs != 1 {
+		t.Errorf("rolled back to %d notes, %d jobs", notes, jobs)
+	}
+}
+
+func TestAtomicGroup(t *testing.T) {
+	lv := testLv(newApp())
+	g := lv.Group(1)
+
+	lv.setTx(&pg.Tx{})
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, ErrAtomicJobs) {
+					t.Errorf("raised %v", err)
+				}
+			}()
+			g.Go("fetch", func(context.Context) error { return nil })
+		}()
+	}
+	lv.setTx(nil)
+
+	// the refused jobs took no room
+	g.Go("fetch", func(context.Context) error { return nil })
+	if err := g.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAtomicPaperworkJobs(t *testing.T) {
+	var failed error
+
+	app := newApp()
+	app.logger = reporter(func(*Lv) error { return nil })
+	app.MapErrors(func(lv *Lv, err error) bool {
+		failed = err
+		return false
+	})
+
+	release := make(chan struct{})
+	app.router.POST("/", func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Go(func() { <-release })
+		defer close(release)
+
+		return lv.Paperwork(&noteForm{}, true)
+	})
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	app.router.ServeHTTP(rec, req)
+	if rec.Code != 500 || !errors.Is(failed, ErrAtomicJobs) {
+		t.Errorf("got %d: %v", rec.Code, failed)
+	}
+}
+
+type knol struct {
+	Node
+}
+
+func (knol) Class() quad.IRI { return "levi:test/Knol" }
+
+type fakeKnol struct {
+	Node
+}
+
+func (*fakeKnol) Class() quad.IRI { return "levi:test/Knol" }
+
+func TestRegisterGraph(t *testing.T) {
+	app := newApp()
+	app.Register(knol{}, &knol{})
+
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, ErrDupClass) {
+			t.Errorf("got %v", err)
+		}
+	}()
+	app.Register(&fakeKnol{})
+}
+
+// setenv sets the variables for the test, or unsets the ones
+// set to "", and restores them afterwards.
+func setenv(t *testing.T, vars map[string]string) {
+	for key, value := range vars {
+		key := key
+		if old, ok := os.LookupEnv(key); ok {
+			t.Cleanup(func() { os.Setenv(key, old) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(key) })
+		}
+
+		if value == "" {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	setenv(t, map[string]string{
+		"PORT":             "8080",
+		"PRODUCTION":       "true",
+		"LOG_GROUP_WINDOW": "nope",
+		"DOMAIN":           "",
+		"DATABASE_URL":     "",
+	})
+
+	cfg := &Config{DatabaseURL: "postgresql://localhost/db"}
+	err := loadEnv(cfg)
+
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected ConfigError, got %v", err)
+	}
+	if !reflect.DeepEqual(cerr.Missing, []string{"DOMAIN"}) {
+		t.Errorf("missing: %v", cerr.Missing)
+	}
+	if len(cerr.Invalid) != 1 {
+		t.Errorf("invalid: %v", cerr.Invalid)
+	}
+	if cfg.Port != "8080" || !cfg.Production {
+		t.Errorf("not loaded: %+v", cfg)
+	}
+}
+
+func TestDotEnvInProduction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	err = ioutil.WriteFile(".env", []byte("LOG_LEVEL=error\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, map[string]string{"LOG_LEVEL": "", "PRODUCTION": ""})
+
+	for prod, want := range map[bool]Logotype{true: WARNING, false: ERROR} {
+		os.Unsetenv("LOG_LEVEL")
+
+		app, err := New(&Config{
+			Port:        "8080",
+			Domain:      "example.com",
+			DatabaseURL: "postgresql://localhost/db",
+			Production:  prod,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if app.level != want {
+			t.Errorf("production %v: level %s", prod, app.level.Level())
+		}
+	}
+}
+
+func TestMigrationRange(t *testing.T) {
+	mi := &Migration{From: 1, To: 3}
+	up := mi.Up()
+	for v, want := range []bool{false, false, true, true, false} {
+		if up(v) != want {
+			t.Errorf("up(%d) = %v", v, !want)
+		}
+	}
+
+	mi = &Migration{From: 3, To: 1}
+	down := mi.Down()
+	for v, want := range []bool{false, false, true, true, false} {
+		if down(v) != want {
+			t.Errorf("down(%d) = %v", v, !want)
+		}
+	}
+}
+
+// versioned records the steps it migrates, also in the
+// levi_test_steps table, if migrated against the database.
+type versioned struct {
+	ran []string
+}
+
+func (*versioned) Type() Archetype { return TABLE }
+
+func (*versioned) Version() int { return 4 }
+
+func (m *versioned) Up(mi *Migration) error {
+	v := mi.Up()
+	for n := 1; n <= 4; n++ {
+		if v(n) {
+			if err := m.step(mi, fmt.Sprintf("up %d", n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *versioned) Down(mi *Migration) error {
+	v := mi.Down()
+	for n := 4; n >= 1; n-- {
+		if v(n) {
+			if err := m.step(mi, fmt.Sprintf("down %d", n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *versioned) step(mi *Migration, name string) error {
+	m.ran = append(m.ran, name)
+	if mi.Tx == nil {
+		return nil
+	}
+	_, err := mi.Exec(`INSERT INTO levi_test_steps VALUES (?)`, name)
+	return err
+}
+
+func TestMigrateTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := newApp()
+	app.cfg.MigrationsDir = dir
+
+	m := &versioned{}
+	if err := app.migrateTable(nil, m, "versioned", 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.migrateTable(nil, m, "versioned", 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"up 2", "up 3", "down 4", "down 3"}
+	if !reflect.DeepEqual(m.ran, want) {
+		t.Errorf("ran %q, want %q", m.ran, want)
+	}
+}
+
+func TestMigrateTableScripts(t *testing.T) {
+	db := testDB(t)
+	dir, err := ioutil.TempDir("", "levi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := newApp()
+	app.cfg.MigrationsDir = dir
+	os.Mkdir(filepath.Join(dir, "versioned"), 0755)
+	for v := 1; v <= 2; v++ {
+		for _, kind := range []string{"up", "down"} {
+			script := fmt.Sprintf("INSERT INTO levi_test_steps VALUES ('%s.sql %d')", kind, v)
+			if err := ioutil.WriteFile(app.scriptPath("versioned", v, kind), []byte(script), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS levi_test_steps (name text, id serial)`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP TABLE levi_test_steps`) })
+
+	err = db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := app.migrateTable(tx, &versioned{}, "versioned", 0, 2); err != nil {
+			return err
+		}
+		return app.migrateTable(tx, &versioned{}, "versioned", 2, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []string
+	if _, err := db.Query(&ran, `SELECT name FROM levi_test_steps ORDER BY id`); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"up 1", "up.sql 1", "up 2", "up.sql 2",
+		"down.sql 2", "down 2", "down.sql 1", "down 1",
+	}
+	if !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+}
+
+func TestDryRunLeavesNoTable(t *testing.T) {
+	app := newApp()
+	app.db = testDB(t)
+
+	if _, err := app.db.Exec(`DROP TABLE IF EXISTS migrations`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.MigrateDryRun(); err != nil {
+		t.Fatal(err)
+	}
+
+	var exists bool
+	_, err := app.db.QueryOne(pg.Scan(&exists), `SELECT to_regclass('migrations') IS NOT NULL`)
+	if err != nil || exists {
+		t.Errorf("migrations table after a dry run: %v, %v", exists, err)
+	}
+}
+
+func TestMigrationsTableUpgrade(t *testing.T) {
+	app := newApp()
+	app.db = testDB(t)
+
+	// as left behind by the older levi
+	_, err := app.db.Exec(`DROP TABLE IF EXISTS migrations;
+CREATE TABLE migrations ("table" text, version int);
+INSERT INTO migrations VALUES ('users', 2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.db.Exec(`DROP TABLE migrations`) })
+
+	if v, err := storedVersions(app.db); err != nil || v["users"] != 2 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+
+	err = app.db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := recordVersion(tx, "users", 3); err != nil {
+			return err
+		}
+		return recordVersion(tx, "posts", 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := storedVersions(app.db)
+	if err != nil || !reflect.DeepEqual(v, map[string]int{"users": 3, "posts": 1}) {
+		t.Errorf("got %v, %v", v, err)
+	}
+}
+
+func TestSplitIdent(t *testing.T) {
+	for ident, want := range map[string][]string{
+		`users`:               {"users"},
+		`"users"`:             {"users"},
+		`"app"."users"`:       {"app", "users"},
+		`app."user.events"`:   {"app", "user.events"},
+		`"a ""quoted"" name"`: {`a "quoted" name`},
+	} {
+		if got := splitIdent(ident); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitIdent(%s) = %q", ident, got)
+		}
+	}
+
+	create, drop := uniqueIndex(`"app"."users"`, "login")
+	if want := `CREATE UNIQUE INDEX IF NOT EXISTS "users_login_key" ON "app"."users" ("login");`; create != want {
+		t.Errorf("got %s", create)
+	}
+	if want := `DROP INDEX IF EXISTS "app"."users_login_key";`; drop != want {
+		t.Errorf("got %s", drop)
+	}
+}
+
+func TestSQLType(t *testing.T) {
+	for declared, want := range map[string]string{
+		"bigserial":    "bigint",
+		"timestamptz":  "timestamp with time zone",
+		"varchar(8)[]": "character varying(8)[]",
+		"jsonb":        "jsonb",
+		"TEXT[]":       "text[]",
+	} {
+		if got := sqlType(declared); got != want {
+			t.Errorf("sqlType(%q) = %q, want %q", declared, got, want)
+		}
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	old := []snapColumn{
+		{Name: "id", Type: "bigserial", NotNull: true},
+		{Name: "login", Type: "text"},
+	}
+	cur := []snapColumn{
+		{Name: "id", Type: "bigserial", NotNull: true},
+		{Name: "username", Type: "text", Unique: true},
+	}
+
+	up, down := diffSnapshots(`"users"`, old, cur)
+	want := []string{
+		`-- hint: login may have been renamed to username: ALTER TABLE "users" RENAME COLUMN "login" TO "username";`,
+		`ALTER TABLE "users" ADD COLUMN "username" text;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "users_username_key" ON "users" ("username");`,
+		`ALTER TABLE "users" DROP COLUMN "login";`,
+	}
+	if !reflect.DeepEqual(up, want) {
+		t.Errorf("up:\n%s", strings.Join(up, "\n"))
+	}
+	if len(down) != 2 {
+		t.Errorf("down:\n%s", strings.Join(down, "\n"))
+	}
+}
+
+func TestFoldLogs(t *testing.T) {
+	us := time.Microsecond
+	logs := []Log{
+		{How: PRINT, When: 0, What: []byte("INCOMING")},
+		{How: DEBUG, When: 10 * us, What: []byte("a")},
+		{How: DEBUG, When: 50 * us, What: []byte("b")},
+		{How: DEBUG, When: 400 * us, What: []byte("c")},
+		{How: ERROR, When: 420 * us, What: []byte("d")},
+		{How: PRINT, When: 500 * us, What: []byte("FINISHED")},
+		{How: PRINT, When: 510 * us, What: []byte("POOL")},
+	}
+
+	var sizes []int
+	for _, g := range FoldLogs(logs, 100*us) {
+		sizes = append(sizes, len(g.Logs))
+	}
+	if !reflect.DeepEqual(sizes, []int{1, 2, 1, 1, 1, 1}) {
+		t.Errorf("groups: %v", sizes)
+	}
+
+	if n := len(FoldLogs(logs, 0)); n != len(logs) {
+		t.Errorf("grouped with no window: %d", n)
+	}
+}
+
+func TestKvString(t *testing.T) {
+	kv := Kv{"user": 42, "name": "John Doe", "empty": ""}
+	if got, want := kv.String(), `empty="" name="John Doe" user=42`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.logger = &JSONLogger{Out: &out}
+	app.router.GET("/users/:id", func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Tag(Kv{"user": 42, "done": make(chan int)})
+		lv.With(Kv{"attempt": 2}).Warn("slow")
+		return lv.NoContent(204)
+	})
+
+	req := httptest.NewRequest("GET", "/users/42", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	app.router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var report struct {
+		Method    string
+		Path      string
+		Status    int
+		RequestID string `json:"request_id"`
+		Fields    map[string]interface{}
+		Entries   []struct {
+			Level   string
+			Message string
+			Fields  map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+
+	if report.Method != "GET" || report.Path != "/users/42" || report.Status != 204 {
+		t.Errorf("got %s %s %d", report.Method, report.Path, report.Status)
+	}
+	if report.RequestID != "req-1" {
+		t.Errorf("request_id %q", report.RequestID)
+	}
+	if report.Fields["user"] != 42.0 {
+		t.Errorf("fields %v", report.Fields)
+	}
+	if done, _ := report.Fields["done"].(string); !strings.HasPrefix(done, "0x") {
+		t.Errorf("chan printed as %v", report.Fields["done"])
+	}
+	if len(report.Entries) != 1 {
+		t.Fatalf("entries %+v", report.Entries)
+	}
+	if e := report.Entries[0]; e.Level != "warning" || e.Message != "slow" || e.Fields["attempt"] != 2.0 {
+		t.Errorf("entry %+v", e)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tp, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || tp.Trace != "4bf92f3577b34da6a3ce929d0e0e4736" || tp.Parent != "00f067aa0ba902b7" {
+		t.Errorf("got %+v", tp)
+	}
+
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(bad); ok {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestOTLPTracer(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+					Status       struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("posted to %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tracer := &OTLPTracer{Endpoint: collector.URL}
+	root := &Span{
+		Trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+		Id:      "00f067aa0ba902b7",
+		Name:    "GET /",
+		Kind:    SERVER,
+		Started: time.Now(),
+		tracer:  tracer,
+	}
+	root.Child("sql", CLIENT).End(errors.New("boom"))
+	root.End(nil)
+
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tracer.stop:
+	default:
+		t.Error("tracer left ticking")
+	}
+	if err := tracer.Close(); err != nil {
+		t.Error(err)
+	}
+
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	sql := spans[0]
+	if sql.TraceID != root.Trace || sql.ParentSpanID != root.Id || sql.Kind != int(CLIENT) || sql.Status.Code != 2 {
+		t.Errorf("sql span: %+v", sql)
+	}
+	if spans[1].Name != "GET /" || spans[1].ParentSpanID != "" {
+		t.Errorf("root span: %+v", spans[1])
+	}
+}
+
+type tracer func(*Span) error
+
+func (t tracer) Export(s *Span) error { return t(s) }
+
+func TestSpanLogs(t *testing.T) {
+	var root *Span
+
+	// the logs are all kept, up until the request turns
+	// out fine and gets filtered
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.cfg.LogKeepFailed = true
+	app.tracer = tracer(func(s *Span) error {
+		if s.Kind == SERVER {
+			root = s
+		}
+		return nil
+	})
+	app.logger = reporter(func(*Lv) error { return nil })
+	app.router.GET("/", func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Debug("a")
+		lv.Warn("b")
+		lv.Debug("c")
+		return lv.NoContent(204)
+	}, LogLevel(WARNING))
+
+	app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if root == nil {
+		t.Fatal("no span")
+	}
+	var got []string
+	for _, l := range root.Logs {
+		if l.How != PRINT {
+			got = append(got, l.How.Level()+" "+l.Message())
+		}
+	}
+	if want := []string{"debug a", "warning b", "debug c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	m.job(30 * time.Millisecond)
+	m.job(2 * time.Second)
+	m.log(ERROR)
+	m.panic()
+
+	var b bytes.Buffer
+	m.write(&b)
+
+	for _, line := range []string{
+		`levi_job_duration_seconds_bucket{le="0.025"} 0`,
+		`levi_job_duration_seconds_bucket{le="0.05"} 1`,
+		`levi_job_duration_seconds_bucket{le="2.5"} 2`,
+		`levi_job_duration_seconds_bucket{le="+Inf"} 2`,
+		`levi_job_duration_seconds_count 2`,
+		`levi_logs_total{level="error"} 1`,
+		`levi_panics_total 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	app := newApp()
+	app.metrics = newMetrics()
+	app.logger = &StdLogger{Out: ioutil.Discard}
+	app.migrated.Store([]MigrationState{{Table: "users", Current: 3, Latest: 4}})
+
+	// the router knows nothing of the metrics
+	rec := httptest.NewRecorder()
+	app.router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 404 {
+		t.Errorf("public metrics: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %s", ct)
+	}
+	for _, line := range []string{
+		`levi_migration_version{table="users"} 3`,
+		`levi_migration_latest_version{table="users"} 4`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	for err, want := range map[error]int{
+		&ValidationError{Message: "too short"}:   422,
+		fmt.Errorf("%w: eof", ErrBadPaperwork):   400,
+		fmt.Errorf("user: %w", pg.ErrNoRows):     404,
+		&MigrationError{Err: errors.New("boom")}: 500,
+		echo.ErrMethodNotAllowed:                 405,
+		errors.New("boom"):                       500,
+	} {
+		if got := StatusOf(err); got != want {
+			t.Errorf("%v: got %d, want %d", err, got, want)
+		}
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	var got []Logotype
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.logger = reporter(func(lv *Lv) error {
+		got = []Logotype{}
+		for _, l := range lv.Logs {
+			if l.How != PRINT {
+				got = append(got, l.How)
+			}
+		}
+		return nil
+	})
+
+	handler := func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Debug("debug")
+		lv.Warn("warn")
+		if lv.QueryParam("fail") != "" {
+			lv.Error(errors.New("boom"))
+		}
+		return lv.NoContent(204)
+	}
+	app.router.GET("/quiet", handler, LogLevel(WARNING))
+	app.router.GET("/sampled", handler, LogSample(0))
+
+	for _, tc := range []struct {
+		target     string
+		keepFailed bool
+		want       []Logotype
+	}{
+		{"/quiet", false, []Logotype{WARNING}},
+		{"/quiet?fail=1", false, []Logotype{WARNING, ERROR}},
+		{"/quiet", true, []Logotype{WARNING}},
+		{"/quiet?fail=1", true, []Logotype{DEBUG, WARNING, ERROR}},
+		{"/sampled", false, nil},
+		{"/sampled?fail=1", false, []Logotype{DEBUG, WARNING, ERROR}},
+	} {
+		got = nil
+		app.cfg.LogKeepFailed = tc.keepFailed
+		app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.target, nil))
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s (keep failed %v): got %v, want %v", tc.target, tc.keepFailed, got, tc.want)
+		}
+	}
+}
+
+func TestPanicResponse(t *testing.T) {
+	app := newApp()
+	app.logger = &StdLogger{Out: ioutil.Discard}
+	app.router.GET("/", func(echo.Context) error { panic("boom") })
+
+	for _, prod := range []bool{false, true} {
+		app.cfg.Production = prod
+
+		rec := httptest.NewRecorder()
+		app.router.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != 500 {
+			t.Errorf("got %d", rec.Code)
+		}
+		if leaked := strings.Contains(rec.Body.String(), "boom"); leaked == prod {
+			t.Errorf("production %v: %s", prod, rec.Body)
+		}
+	}
+}
+
+func TestConcurrentJobs(t *testing.T) {
+	var (
+		out  bytes.Buffer
+		logs []Log
+	)
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.logger = MultiLogger(&StdLogger{Out: &out}, reporter(func(lv *Lv) error {
+		logs = lv.Logs
+		return nil
+	}))
+	app.router.GET("/", func(c echo.Context) error {
+		lv := c.(*Lv)
+		for i := 0; i < 8; i++ {
+			lv.GoNamed(fmt.Sprint("job", i), func(log *Entry) {
+				for j := 0; j < 100; j++ {
+					log.Debug(j)
+				}
+			})
+		}
+		lv.Go(func() { lv.Tag(Kv{"user": 42}) })
+		return lv.NoContent(204)
+	})
+
+	app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if len(logs) != 800 {
+		t.Fatalf("got %d logs", len(logs))
+	}
+	for i := 1; i < len(logs); i++ {
+		if logs[i].When < logs[i-1].When {
+			t.Fatalf("out of order at %d", i)
+		}
+	}
+	if n := strings.Count(out.String(), "\nJOB job"); n != 8 {
+		t.Errorf("got %d job sections:\n%s", n, out.String())
+	}
+}
+
+type reporter func(*Lv) error
+
+func (r reporter) Report(lv *Lv) error { return r(lv) }
+
+// gatedSink holds every report until the gate is open.
+type gatedSink struct {
+	gate    chan struct{}
+	entered chan struct{}
+	fail    error
+
+	mu      sync.Mutex
+	got     []Logotype
+	flushed int
+}
+
+func newGatedSink() *gatedSink {
+	return &gatedSink{gate: make(chan struct{}), entered: make(chan struct{}, 16)}
+}
+
+func (s *gatedSink) Report(lv *Lv) error {
+	s.entered <- struct{}{}
+	<-s.gate
+
+	s.mu.Lock()
+	s.got = append(s.got, lv.Worst())
+	s.mu.Unlock()
+	return s.fail
+}
+
+func (s *gatedSink) Flush() error {
+	s.mu.Lock()
+	s.flushed++
+	s.mu.Unlock()
+	return nil
+}
+
+func testLv(app *App, logs ...Log) *Lv {
+	c := app.router.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	return &Lv{Context: c, Logs: logs, app: app}
+}
+
+func TestAsyncLogger(t *testing.T) {
+	app := newApp()
+	debug, failed := Log{How: DEBUG}, Log{How: ERROR}
+
+	for _, tc := range []struct {
+		overflow Overflow
+		kept     []Logotype
+		dropped  uint64
+	}{
+		{BLOCK, []Logotype{DEBUG, DEBUG, DEBUG, ERROR}, 0},
+		{DROP, []Logotype{DEBUG, DEBUG, ERROR}, 1},
+		{SAMPLE, []Logotype{DEBUG, DEBUG, ERROR}, 1},
+	} {
+		sink := newGatedSink()
+		a := &AsyncLogger{Sink: sink, Buffer: 1, Overflow: tc.overflow, SampleEvery: 2}
+
+		a.Report(testLv(app, debug))
+		<-sink.entered // the worker is stuck in the sink
+		a.Report(testLv(app, debug))
+
+		// the buffer is full
+		blocked := make(chan struct{})
+		go func() {
+			a.Report(testLv(app, debug))
+			a.Report(testLv(app, failed))
+			close(blocked)
+		}()
+
+		select {
+		case <-blocked:
+			t.Errorf("overflow %d: nothing waited", tc.overflow)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(sink.gate)
+		<-blocked
+		if err := a.Flush(); err != nil {
+			t.Error(err)
+		}
+
+		if !reflect.DeepEqual(sink.got, tc.kept) {
+			t.Errorf("overflow %d: got %v", tc.overflow, sink.got)
+		}
+		if a.Dropped() != tc.dropped {
+			t.Errorf("overflow %d: dropped %d", tc.overflow, a.Dropped())
+		}
+		if sink.flushed == 0 {
+			t.Errorf("overflow %d: sink not flushed", tc.overflow)
+		}
+		if err := a.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	sink := newGatedSink()
+	sink.fail = errors.New("full")
+	close(sink.gate)
+
+	a := &AsyncLogger{Sink: sink}
+	a.Report(testLv(app, debug))
+	a.Flush()
+	if a.Dropped() != 1 {
+		t.Errorf("failed report not dropped: %d", a.Dropped())
+	}
+
+	a.Close()
+	if err := a.Report(testLv(app, failed)); err != sink.fail {
+		t.Errorf("closed: got %v", err)
+	}
+	if len(sink.got) != 2 {
+		t.Errorf("closed: got %v", sink.got)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("closed twice: %v", err)
+	}
+}
+
+func TestMultiLogger(t *testing.T) {
+	app := newApp()
+
+	plain, behind := newGatedSink(), newGatedSink()
+	close(plain.gate)
+	close(behind.gate)
+
+	async := &AsyncLogger{Sink: behind}
+	m := MultiLogger(plain, async)
+
+	if err := m.Report(testLv(app, Log{How: WARNING})); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.(Flusher).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.got) != 1 || len(behind.got) != 1 {
+		t.Errorf("got %v and %v", plain.got, behind.got)
+	}
+	if plain.flushed != 1 || behind.flushed == 0 {
+		t.Errorf("flushed %d and %d", plain.flushed, behind.flushed)
+	}
+
+	if err := m.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if plain.flushed != 2 {
+		t.Errorf("not flushed on close: %d", plain.flushed)
+	}
+
+	async.mu.Lock()
+	closed := async.closed
+	async.mu.Unlock()
+	if !closed {
+		t.Error("async logger left open")
+	}
+}
+
+func TestFileLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := newApp()
+	segments := func(path string) (plain, gzipped []string) {
+		all, _ := filepath.Glob(path + ".2*")
+		for _, name := range all {
+			if strings.HasSuffix(name, ".gz") {
+				gzipped = append(gzipped, name)
+			} else {
+				plain = append(plain, name)
+			}
+		}
+		return
+	}
+
+	// by size: every report but the first rotates
+	path := filepath.Join(dir, "size", "levi.log")
+	f := &FileLogger{Path: path, MaxSize: 1, Keep: 2}
+	for i := 0; i < 5; i++ {
+		if err := f.Report(testLv(app)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, gzipped := segments(path)
+	if len(plain) != 0 || len(gzipped) != 2 {
+		t.Fatalf("kept %v and %v", plain, gzipped)
+	}
+	gz, err := os.Open(gzipped[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	r, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); !bytes.HasPrefix(b, []byte("INCOMING GET /")) {
+		t.Errorf("gzipped %q", b)
+	}
+
+	// by age: the file is fresh, but it was created long ago
+	path = filepath.Join(dir, "age", "levi.log")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	ioutil.WriteFile(path, []byte("old\n"), 0644)
+	ioutil.WriteFile(path+".created",
+		[]byte(time.Now().Add(-48*time.Hour).Format(time.RFC3339Nano)), 0644)
+
+	f = &FileLogger{Path: path, MaxSize: -1, NoCompress: true}
+	f.Report(testLv(app))
+	f.Report(testLv(app))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	plain, gzipped = segments(path)
+	if len(plain) != 1 || len(gzipped) != 0 {
+		t.Fatalf("kept %v and %v", plain, gzipped)
+	}
+	if b, _ := ioutil.ReadFile(plain[0]); string(b) != "old\n" {
+		t.Errorf("rotated %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path); bytes.Count(b, []byte("INCOMING")) != 2 {
+		t.Errorf("current %q", b)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var (
+		logs    []Log
+		waited  error
+		running int32
+		peak    int32
+	)
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.cfg.JobTimeout = 50 * time.Millisecond
+	app.logger = reporter(func(lv *Lv) error {
+		logs = lv.Logs
+		return nil
+	})
+	app.router.GET("/", func(c echo.Context) error {
+		lv := c.(*Lv)
+
+		g := lv.Group(2)
+		for i := 0; i < 6; i++ {
+			i := i
+			g.Go(fmt.Sprint("job", i), func(ctx context.Context) error {
+				if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&peak) {
+					atomic.StoreInt32(&peak, n)
+				}
+				defer atomic.AddInt32(&running, -1)
+
+				if i == 1 {
+					return errors.New("boom")
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+					t.Errorf("job%d not cancelled", i)
+				}
+				return nil
+			})
+		}
+		waited = g.Wait()
+
+		lv.GoNamed("stuck", func(*Entry) { time.Sleep(200 * time.Millisecond) })
+		lv.Go(func() { time.Sleep(200 * time.Millisecond) })
+		return lv.NoContent(204)
+	})
+
+	app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var failed *JobError
+	if !errors.As(waited, &failed) || len(failed.Jobs) != 1 || failed.Jobs[0] != "job1" {
+		t.Errorf("got %v", waited)
+	}
+	if peak > 2 {
+		t.Errorf("%d jobs at once", peak)
+	}
+
+	last := logs[len(logs)-1]
+	if last.How != WARNING || !strings.Contains(string(last.What), "2 stuck jobs after 50ms: stuck, 1 unnamed") {
+		t.Errorf("got %s", last)
+	}
+}
+
+func TestAbandonedJob(t *testing.T) {
+	release, read := make(chan struct{}), make(chan string, 1)
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.cfg.JobTimeout = 10 * time.Millisecond
+	app.logger = reporter(func(*Lv) error { return nil })
+	app.router.GET("/users/:id", func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Set("user", "user "+lv.Param("id"))
+		if lv.Param("id") == "1" {
+			lv.Go(func() {
+				<-release
+				read <- lv.Param("id") + " " + lv.Request().URL.Path + " " + lv.QueryParam("q") +
+					" " + lv.Get("user").(string)
+			})
+		}
+		return lv.NoContent(204)
+	})
+
+	app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1?q=a", nil))
+	// echo hands the recycled context over to the next one
+	app.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2?q=b", nil))
+
+	close(release)
+	if got := <-read; got != "1 /users/1 a user 1" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		reports []*Lv
+	)
+
+	app := newApp()
+	app.cfg.LogSample = 1
+	app.logger = reporter(func(lv *Lv) error {
+		mu.Lock()
+		reports = append(reports, lv)
+		mu.Unlock()
+		return nil
+	})
+
+	responded := make(chan struct{})
+	app.router.GET("/", func(c echo.Context) error {
+		lv := c.(*Lv)
+		lv.Detach("email", func(lv *Lv) {
+			<-responded
+			lv.Debug("sending")
+			panic("smtp is down")
+		})
+		return lv.NoContent(202)
+	})
+
+	rec := httptest.NewRecorder()
+	app.router.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 202 {
+		t.Errorf("got %d", rec.Code)
+	}
+	close(responded)
+	app.drain.Wait()
+
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports", len(reports))
+	}
+	req, detached := reports[0], reports[1]
+	if detached.detached != "email" || detached.id != req.id {
+		t.Errorf("detached %q from %s, request %s", detached.detached, detached.id, req.id)
+	}
+	if detached.Worst() != PANIC || len(detached.Logs) != 2 {
+		t.Errorf("detached logs: %v", detached.Logs)
+	}
+
+	// once the work is drained, the new one is refused
+	reports = nil
+	app.draining = true
+	ran := false
+	lv := testLv(app)
+	lv.Detach("late", func(*Lv) { ran = true })
+	lv.launch()
+	app.drain.Wait()
+	if ran || len(reports) != 1 || !strings.Contains(string(reports[0].Logs[0].What), ErrShutdown.Error()) {
+		t.Errorf("refused with %v", reports)
+	}
+
+	// a queue with no database to go to
+	app.cues = []Model{&flakyJob{}}
+	if err := testLv(app).DetachWork(&flakyJob{}); !errors.Is(err, ErrNoDatabase) {
+		t.Errorf("got %v", err)
+	}
+}
+
+// restoreValidation puts the rules and the messages back
+// once the test is done.
+func restoreValidation(t *testing.T) {
+	validation.Lock()
+	defer validation.Unlock()
+
+	rules := map[string]Rule{}
+	for name, rule := range validation.rules {
+		rules[name] = rule
+	}
+	params := map[string]func(string) error{}
+	for name, parse := range validation.params {
+		params[name] = parse
+	}
+	messages := map[string]map[string]string{}
+	for lang, m := range validation.messages {
+		messages[lang] = map[string]string{}
+		for rule, msg := range m {
+			messages[lang][rule] = msg
+		}
+	}
+
+	t.Cleanup(func() {
+		validation.Lock()
+		defer validation.Unlock()
+
+		validation.rules, validation.params = rules, params
+		validation.messages = messages
+		forgetPlans()
+	})
+}
+
+func TestValidate(t *testing.T) {
+	restoreValidation(t)
+
+	type Address struct {
+		City string `json:"city" validate:"required"`
+	}
+	type Signup struct {
+		Login    string   `json:"login" validate:"required,min=3,max=8"`
+		Email    string   `json:"email" validate:"required,email"`
+		Site     string   `json:"site" validate:"url"`
+		Password string   `json:"password" validate:"required,min=8"`
+		Repeat   string   `json:"repeat" validate:"eqfield=Password"`
+		Plan     string   `json:"plan" validate:"oneof=free pro"`
+		Handle   string   `json:"handle" validate:"regexp=^[a-z]{2,4}$"`
+		Age      int      `json:"age" validate:"min=18"`
+		Tags     []string `json:"tags" validate:"max=2"`
+		Address  Address  `json:"address"`
+	}
+
+	form := Signup{
+		Login:    "jo",
+		Email:    "jo@",
+		Site:     "example.com",
+		Password: "hunter22",
+		Repeat:   "hunter2",
+		Plan:     "enterprise",
+		Handle:   "jo_o",
+		Age:      17,
+		Tags:     []string{"a", "b", "c"},
+	}
+
+	err := ValidateIn(&form, "de-DE,de;q=0.9")
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v", err)
+	}
+
+	var got []string
+	for _, e := range invalid.Errors {
+		got = append(got, e.Field+" "+e.Rule)
+	}
+	want := []string{
+		"login min", "email email", "site url", "repeat eqfield", "plan oneof",
+		"handle regexp", "age min", "tags max", "address.city required",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+	if invalid.Message != "login must be at least 3 characters long" {
+		t.Errorf("got %q", invalid.Message)
+	}
+
+	RegisterMessages("de", map[string]string{"required": "{field} fehlt"})
+	err = ValidateIn(&Address{}, "de-DE,de;q=0.9")
+	if err.(*ValidationError).Message != "city fehlt" {
+		t.Errorf("got %v", err)
+	}
+
+	RegisterRule("even", func(v reflect.Value, _ string) bool { return v.Int()%2 == 0 })
+	if err := ValidateIn(struct {
+		N int `validate:"even"`
+	}{3}, ""); err == nil || err.(*ValidationError).Message != "N is invalid" {
+		t.Errorf("got %v", err)
+	}
+
+	// the empty values are still compared and counted
+	err = ValidateIn(&struct {
+		Count    int    `validate:"min=1"`
+		Email    string `validate:"email,min=3"`
+		Name     string `validate:"required,min=3"`
+		Password string
+		Repeat   string `validate:"eqfield=Password"`
+	}{Password: "hunter2"}, "")
+	got = nil
+	if errors.As(err, &invalid) {
+		for _, e := range invalid.Errors {
+			got = append(got, e.Field+" "+e.Rule)
+		}
+	}
+	if want := []string{"Count min", "Name required", "Repeat eqfield"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("empty: got %v", got)
+	}
+
+	// a field behind a nil embedded pointer is no match
+	type Credentials struct {
+		Password string
+	}
+	err = ValidateIn(&struct {
+		*Credentials
+		Repeat string `validate:"eqfield=Password"`
+	}{Repeat: "hunter2"}, "")
+	if !errors.As(err, &invalid) || len(invalid.Errors) != 1 || invalid.Errors[0].Rule != "eqfield" {
+		t.Errorf("nil embedded: got %v", err)
+	}
+
+	for _, form := range []interface{}{
+		&struct {
+			A string `validate:"nope"`
+		}{"a"},
+		&struct {
+			A int `validate:"min=three"`
+		}{},
+		&struct {
+			A string `validate:"regexp=("`
+		}{"a"},
+		&struct {
+			A string `validate:"eqfield=B"`
+		}{},
+	} {
+		if err := ValidateIn(form, ""); !errors.Is(err, ErrBadRule) {
+			t.Errorf("%T: got %v", form, err)
+		}
+	}
+}
+
+type signupForm struct {
+	Login string `json:"login" validate:"required,min=3"`
+	Email string `json:"email" validate:"email"`
+}
+
+func (f *signupForm) Apply(lv *Lv) error {
+	return lv.JSON(201, f)
+}
+
+func TestPaperwork(t *testing.T) {
+	app := newApp()
+	app.logger = &StdLogger{Out: ioutil.Discard}
+	app.router.POST("/signup", func(c echo.Context) error {
+		return c.(*Lv).Paperwork(&signupForm{})
+	})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/signup", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		app.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(`{"login": "jo", "email": "jo@"}`)
+	var invalid ValidationError
+	if err := json.Unmarshal(rec.Body.Bytes(), &invalid); err != nil || rec.Code != 422 {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if invalid.OK || invalid.Field != "login" || invalid.Message != "login must be at least 3 characters long" ||
+		len(invalid.Errors) != 2 || invalid.Errors[1].Field != "email" || invalid.Errors[1].Rule != "email" {
+		t.Errorf("got %+v", invalid)
+	}
+
+	if rec := post(`{"login": `); rec.Code != 400 {
+		t.Errorf("malformed: got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = post(`{"login": "john"}`)
+	if rec.Code != 201 || !strings.Contains(rec.Body.String(), `"login":"john"`) {
+		t.Errorf("applied: got %d %s", rec.Code, rec.Body)
+	}
+}
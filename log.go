@@ -2,7 +2,12 @@ package levi
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/labstack/echo"
 )
 
 // Logotype allows to differentiate between log messages.
@@ -33,28 +38,226 @@ func (k Logotype) String() string {
 	}
 }
 
+// Level is the name of the log type, as used in the structured logs.
+func (k Logotype) Level() string {
+	switch k {
+	case PRINT:
+		return "print"
+	case DEBUG:
+		return "debug"
+	case WARNING:
+		return "warning"
+	case ERROR:
+		return "error"
+	case PANIC:
+		return "panic"
+	default:
+		panic("levi: unknown Log type")
+	}
+}
+
 // Log is a single log entry.
 type Log struct {
-	How  Logotype
-	When time.Duration
-	What []byte
+	How     Logotype
+	When    time.Duration
+	What    []byte
+	With    Kv     // fields, see Lv.With
+	Request string // see Lv.RequestID
+	Job     string // see Lv.GoNamed
+}
+
+// Message is What, without the trailing newline, followed
+// by the fields, if any.
+func (l Log) Message() string {
+	msg := strings.TrimRight(string(l.What), "\n")
+	if len(l.With) != 0 {
+		msg += " " + l.With.String()
+	}
+	return msg
 }
 
 func (l Log) String() string {
 	if l.How == PRINT {
-		return string(l.What)
+		return l.Message()
+	}
+	return fmt.Sprintf("<%s> [%s] %s", l.How, l.When, l.Message())
+}
+
+// LogGroup is a run of adjacent same-level logs, each within
+// the LogGroupWindow of the previous one.
+type LogGroup struct {
+	How  Logotype
+	When time.Duration // of the first log
+	Job  string
+	Logs []Log
+}
+
+func (g LogGroup) String() string {
+	if len(g.Logs) == 1 {
+		return g.Logs[0].String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s> [%s] ×%d", g.How, g.When, len(g.Logs))
+	for _, l := range g.Logs {
+		fmt.Fprintf(&b, "\n%12s %s", "+"+(l.When-g.When).String(), l.Message())
+	}
+	return b.String()
+}
+
+// FoldLogs groups the adjacent same-level logs that are no
+// further than the window apart. PRINT logs are never grouped,
+// neither are the logs of different jobs, nor is anything if
+// the window is not positive.
+func FoldLogs(logs []Log, window time.Duration) []LogGroup {
+	groups := make([]LogGroup, 0, len(logs))
+	for _, l := range logs {
+		if n := len(groups); n != 0 && window > 0 && l.How != PRINT {
+			last := &groups[n-1]
+			prev := last.Logs[len(last.Logs)-1]
+			if last.How == l.How && last.Job == l.Job && l.When-prev.When <= window {
+				last.Logs = append(last.Logs, l)
+				continue
+			}
+		}
+
+		groups = append(groups, LogGroup{l.How, l.When, l.Job, []Log{l}})
+	}
+
+	return groups
+}
+
+// Worst is the most severe type among the request logs.
+func (lv *Lv) Worst() Logotype {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	worst := PRINT
+	for _, l := range lv.Logs {
+		if l.How > worst {
+			worst = l.How
+		}
+	}
+	return worst
+}
+
+// ParseLogotype parses the level name, see Level.
+func ParseLogotype(level string) (Logotype, error) {
+	for k := PRINT; k <= PANIC; k++ {
+		if strings.EqualFold(level, k.Level()) {
+			return k, nil
+		}
+	}
+	return PRINT, fmt.Errorf("%w: %q", ErrBadLogLevel, level)
+}
+
+// LogLevel sets the least severe logs reported for the route:
+//
+//	e.GET("/hot", handler, levi.LogLevel(levi.ERROR))
+//
+func LogLevel(min Logotype) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if lv, ok := c.(*Lv); ok {
+				lv.mu.Lock()
+				lv.level = min
+				lv.mu.Unlock()
+			}
+			return next(c)
+		}
+	}
+}
+
+// LogSample sets the share of successful requests reported
+// for the route, from 0 to 1.
+func LogSample(rate float64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if lv, ok := c.(*Lv); ok {
+				lv.mu.Lock()
+				lv.sample = rate
+				lv.mu.Unlock()
+			}
+			return next(c)
+		}
 	}
-	return fmt.Sprintf("<%s> [%s] %s", l.How, l.When, l.What)
+}
+
+// filter drops the logs below the request level, unless the
+// request has failed and LogKeepFailed is on; it also samples
+// out the successful requests. It reports whether the request
+// is to be reported at all.
+func (lv *Lv) filter() bool {
+	failed := lv.Worst() >= ERROR || lv.Response().Status >= 500
+
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	if !failed && lv.sample < 1 && rand.Float64() >= lv.sample {
+		return false
+	}
+
+	if failed && lv.app.cfg.LogKeepFailed {
+		return true
+	}
+
+	kept := lv.Logs[:0]
+	for _, l := range lv.Logs {
+		if l.How == PRINT || l.How >= lv.level {
+			kept = append(kept, l)
+		}
+	}
+	lv.Logs = kept
+
+	return true
+}
+
+// Groups folds the request logs, see LogGroupWindow; the
+// handler's own logs go first, followed by a section per job
+// in the order the jobs started logging.
+func (lv *Lv) Groups() []LogGroup {
+	lv.mu.Lock()
+	logs := append([]Log(nil), lv.Logs...)
+	lv.mu.Unlock()
+
+	section := map[string]int{"": 0}
+	for _, l := range logs {
+		if _, ok := section[l.Job]; !ok {
+			section[l.Job] = len(section)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return section[logs[i].Job] < section[logs[j].Job]
+	})
+
+	window := time.Duration(lv.app.cfg.LogGroupWindow) * time.Microsecond
+	return FoldLogs(logs, window)
 }
 
 func (lv *Lv) log(kind Logotype, stuff ...interface{}) {
-	log := Log{kind, time.Now().Sub(lv.started), []byte(fmt.Sprintln(stuff...))}
-	lv.Logs = append(lv.Logs, log)
+	lv.record(kind, nil, "", fmt.Sprintln(stuff...))
 }
 
 func (lv *Lv) logf(kind Logotype, format string, stuff ...interface{}) {
-	log := Log{kind, time.Now().Sub(lv.started), []byte(fmt.Sprintf(format, stuff...))}
-	lv.Logs = append(lv.Logs, log)
+	lv.record(kind, nil, "", fmt.Sprintf(format, stuff...))
+}
+
+// record is safe to call from the jobs; the offsets are
+// taken under the lock, so the logs are ordered by When.
+func (lv *Lv) record(kind Logotype, kv Kv, job, what string) {
+	lv.app.metrics.log(kind)
+
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	if kind != PRINT && kind < lv.level && !lv.app.cfg.LogKeepFailed {
+		return
+	}
+
+	if !lv.abandoned {
+		log := Log{kind, time.Now().Sub(lv.started), []byte(what), kv, lv.id, job}
+		lv.Logs = append(lv.Logs, log)
+	}
 }
 
 func (lv *Lv) Debug(info ...interface{})              { lv.log(DEBUG, info...) }
@@ -65,3 +268,65 @@ func (lv *Lv) Error(err error)                        { lv.log(ERROR, err) }
 func (lv *Lv) Errorf(fmt string, data ...interface{}) { lv.logf(ERROR, fmt, data...) }
 func (lv *Lv) Panic(msg ...interface{})               { lv.log(PANIC, msg...) }
 func (lv *Lv) Panicf(fmt string, data ...interface{}) { lv.logf(PANIC, fmt, data...) }
+
+// Tag attaches the fields to the whole request, e.g. the
+// user, tenant or order id. Later tags override earlier ones.
+func (lv *Lv) Tag(kv Kv) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	if lv.abandoned {
+		return
+	}
+	if lv.Fields == nil {
+		lv.Fields = Kv{}
+	}
+	for k, v := range kv {
+		lv.Fields[k] = v
+	}
+}
+
+// With attaches the fields to a single log entry:
+//
+//	lv.With(levi.Kv{"user": id}).Warn("password expired")
+//
+func (lv *Lv) With(kv Kv) *Entry {
+	return &Entry{lv: lv, kv: kv}
+}
+
+// Entry is a log entry in the making, carrying its fields
+// and the job it's logged from, if any.
+type Entry struct {
+	lv  *Lv
+	kv  Kv
+	job string
+}
+
+// With adds more fields to the entry.
+func (e *Entry) With(kv Kv) *Entry {
+	merged := make(Kv, len(e.kv)+len(kv))
+	for k, v := range e.kv {
+		merged[k] = v
+	}
+	for k, v := range kv {
+		merged[k] = v
+	}
+	return &Entry{e.lv, merged, e.job}
+}
+
+func (e *Entry) log(kind Logotype, stuff ...interface{}) {
+	e.lv.record(kind, e.kv, e.job, fmt.Sprintln(stuff...))
+}
+
+func (e *Entry) logf(kind Logotype, format string, stuff ...interface{}) {
+	e.lv.record(kind, e.kv, e.job, fmt.Sprintf(format, stuff...))
+}
+
+func (e *Entry) Debug(info ...interface{})              { e.log(DEBUG, info...) }
+func (e *Entry) Debugf(fmt string, info ...interface{}) { e.logf(DEBUG, fmt, info...) }
+func (e *Entry) Warn(msg ...interface{})                { e.log(WARNING, msg...) }
+func (e *Entry) Warnf(fmt string, data ...interface{})  { e.logf(WARNING, fmt, data...) }
+func (e *Entry) Error(err error)                        { e.log(ERROR, err) }
+func (e *Entry) Errorf(fmt string, data ...interface{}) { e.logf(ERROR, fmt, data...) }
+func (e *Entry) Panic(msg ...interface{})               { e.log(PANIC, msg...) }
+func (e *Entry) Panicf(fmt string, data ...interface{}) { e.logf(PANIC, fmt, data...) }
@@ -1,8 +1,16 @@
 package levi
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
 )
 
 // Logger performs the logging once the request is finished.
@@ -10,15 +18,172 @@ type Logger interface {
 	Report(*Lv) error
 }
 
+// Flusher is a Logger that holds on to the reports; Wake
+// flushes it once the server is shut down, or closes it, if
+// it's an io.Closer.
+type Flusher interface {
+	Flush() error
+}
+
+// StdLogger prints human-readable request logs.
 type StdLogger struct {
 	sync.Mutex
+
+	// Default: os.Stdout.
+	Out io.Writer
 }
 
 func (std *StdLogger) Report(lv *Lv) error {
-	std.Lock()
-	for _, log := range lv.Logs {
-		fmt.Println(log)
+	var b bytes.Buffer
+	writeReport(&b, lv)
+
+	out := std.Out
+	if out == nil {
+		out = os.Stdout
 	}
+
+	std.Lock()
+	_, err := b.WriteTo(out)
 	std.Unlock()
-	return nil
+	return err
+}
+
+// writeReport renders the human-readable request log.
+func writeReport(w io.Writer, lv *Lv) {
+	req := lv.Request()
+	if lv.detached != "" {
+		fmt.Fprintf(w, "DETACHED %s FROM %s %s ID %s NOW %s\n",
+			lv.detached, req.Method, req.URL.Path, lv.id,
+			lv.started.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "INCOMING %s %s ID %s NOW %s ADDR %s AGENT %s\n",
+			req.Method, req.URL.Path, lv.id,
+			lv.started.Format(time.RFC3339),
+			lv.Addr(), lv.Agent())
+	}
+	if len(lv.Fields) != 0 {
+		fmt.Fprintln(w, "WITH", lv.Fields)
+	}
+	job := ""
+	for _, group := range lv.Groups() {
+		if group.Job != job {
+			job = group.Job
+			fmt.Fprintln(w, "JOB", job)
+		}
+		fmt.Fprintln(w, group)
+	}
+	if lv.Pool != nil {
+		fmt.Fprintf(w, "POOL %d/%d IDLE %d TIMEOUTS %d\n",
+			lv.Pool.TotalConns, lv.app.db.Options().PoolSize,
+			lv.Pool.IdleConns, lv.Pool.Timeouts)
+	}
+	fmt.Fprintf(w, "FINISHED WITH %d ELAPSED %s\n\n",
+		lv.Response().Status, lv.Elapsed())
+}
+
+// JSONLogger writes one JSON document per request, one
+// per line, fit for ingestion by Loki, ELK and the likes.
+type JSONLogger struct {
+	sync.Mutex
+
+	// Default: os.Stdout.
+	Out io.Writer
+}
+
+type jsonReport struct {
+	Time      time.Time      `json:"time"`
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Status    int            `json:"status"`
+	Latency   float64        `json:"latency_ms"`
+	Addr      string         `json:"addr"`
+	Agent     string         `json:"agent"`
+	Detached  string         `json:"detached,omitempty"`
+	RequestID string         `json:"request_id"`
+	TraceID   string         `json:"trace_id"`
+	Pool      *pg.PoolStats  `json:"pool,omitempty"`
+	Fields    Kv             `json:"fields,omitempty"`
+	Entries   []jsonLogEntry `json:"entries"`
+}
+
+type jsonLogEntry struct {
+	Level   string  `json:"level"`
+	Offset  float64 `json:"offset_ms"`
+	Message string  `json:"message"`
+	Fields  Kv      `json:"fields,omitempty"`
+	Job     string  `json:"job,omitempty"`
+}
+
+func (j *JSONLogger) Report(lv *Lv) error {
+	req := lv.Request()
+	report := jsonReport{
+		Time:      lv.started,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Status:    lv.Response().Status,
+		Latency:   millis(lv.Elapsed()),
+		Addr:      lv.Addr(),
+		Agent:     lv.Agent(),
+		Detached:  lv.detached,
+		RequestID: lv.id,
+		TraceID:   lv.trace.Trace,
+		Pool:      lv.Pool,
+		Fields:    lv.Fields,
+		Entries:   make([]jsonLogEntry, 0, len(lv.Logs)),
+	}
+
+	for _, l := range lv.Logs {
+		report.Entries = append(report.Entries, jsonLogEntry{
+			Level:   l.How.Level(),
+			Offset:  millis(l.When),
+			Message: strings.TrimRight(string(l.What), "\n"),
+			Fields:  l.With,
+			Job:     l.Job,
+		})
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		// some value is beyond JSON, so the fields are
+		// settled for their printed form
+		report.Fields = printable(report.Fields)
+		for i := range report.Entries {
+			report.Entries[i].Fields = printable(report.Entries[i].Fields)
+		}
+		b, err = json.Marshal(report)
+	}
+	if err != nil {
+		return fmt.Errorf("levi: failure to format : %w", err)
+	}
+
+	out := j.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	j.Lock()
+	_, err = out.Write(append(b, '\n'))
+	j.Unlock()
+	return err
+}
+
+// printable replaces the values that fail to marshal with
+// their fmt.Sprint.
+func printable(h Kv) Kv {
+	if h == nil {
+		return nil
+	}
+
+	kv := make(Kv, len(h))
+	for k, v := range h {
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprint(v)
+		}
+		kv[k] = v
+	}
+	return kv
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
 }
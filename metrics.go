@@ -0,0 +1,261 @@
+package levi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exposed at /metrics on MetricsAddr, in the
+// Prometheus text format, once enabled in the config:
+//
+//	levi_requests_total{method,route,status}
+//	levi_request_duration_seconds{method,route,status}
+//	levi_logs_total{level}
+//	levi_panics_total
+//	levi_job_duration_seconds
+//	levi_db_pool_*
+//	levi_migration_version{table}
+//	levi_migration_latest_version{table}
+//
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]*histogram
+	jobs     histogram
+
+	logs   [PANIC + 1]uint64
+	panics uint64
+}
+
+type requestLabels struct {
+	method, route string
+	status        int
+}
+
+// buckets are the Prometheus defaults, in seconds.
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+
+	s := d.Seconds()
+	if i := sort.SearchFloat64s(buckets, s); i < len(buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += s
+}
+
+func newMetrics() *metrics {
+	return &metrics{requests: map[requestLabels]*histogram{}}
+}
+
+// The recording methods are no-ops with the metrics off.
+
+func (m *metrics) request(lv *Lv) {
+	if m == nil {
+		return
+	}
+
+	route := lv.Path()
+	if route == "" {
+		route = "unmatched"
+	}
+	key := requestLabels{lv.Request().Method, route, lv.Response().Status}
+
+	m.mu.Lock()
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{}
+		m.requests[key] = h
+	}
+	h.observe(lv.Elapsed())
+	m.mu.Unlock()
+}
+
+func (m *metrics) log(kind Logotype) {
+	if m != nil {
+		atomic.AddUint64(&m.logs[kind], 1)
+	}
+}
+
+func (m *metrics) panic() {
+	if m != nil {
+		atomic.AddUint64(&m.panics, 1)
+	}
+}
+
+func (m *metrics) job(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.jobs.observe(d)
+	m.mu.Unlock()
+}
+
+// listenMetrics serves /metrics on MetricsAddr, apart from
+// the router, so that it's neither public nor logged; the
+// failure to listen goes to failed.
+func (app *App) listenMetrics(failed chan<- error) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", app.serveMetrics)
+
+	server := &http.Server{Addr: app.cfg.MetricsAddr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- fmt.Errorf("levi: metrics: %w", err)
+		}
+	}()
+
+	return server
+}
+
+// serveMetrics is the /metrics handler.
+func (app *App) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	app.metrics.write(&b)
+
+	if app.db != nil {
+		writePool(&b, app)
+	}
+	writeMigrations(&b, app)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b.WriteTo(w)
+}
+
+func (m *metrics) write(b *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestLabels, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	labels := func(key requestLabels) string {
+		return fmt.Sprintf(`method="%s",route="%s",status="%d"`,
+			escapeLabel(key.method), escapeLabel(key.route), key.status)
+	}
+
+	header(b, "levi_requests_total", "counter", "Requests served.")
+	for _, key := range keys {
+		fmt.Fprintf(b, "levi_requests_total{%s} %d\n", labels(key), m.requests[key].count)
+	}
+
+	header(b, "levi_request_duration_seconds", "histogram", "Time to serve a request, jobs included.")
+	for _, key := range keys {
+		writeHistogram(b, "levi_request_duration_seconds", labels(key), m.requests[key])
+	}
+
+	header(b, "levi_logs_total", "counter", "Log entries emitted, by level.")
+	for kind := DEBUG; kind <= PANIC; kind++ {
+		fmt.Fprintf(b, "levi_logs_total{level=\"%s\"} %d\n",
+			kind.Level(), atomic.LoadUint64(&m.logs[kind]))
+	}
+
+	header(b, "levi_panics_total", "counter", "Panics recovered from the handlers.")
+	fmt.Fprintf(b, "levi_panics_total %d\n", atomic.LoadUint64(&m.panics))
+
+	header(b, "levi_job_duration_seconds", "histogram", "Time taken by the Lv.Go jobs.")
+	writeHistogram(b, "levi_job_duration_seconds", "", &m.jobs)
+}
+
+func writePool(b *bytes.Buffer, app *App) {
+	pool := app.db.PoolStats()
+
+	for _, c := range []struct {
+		name, help string
+		value      uint32
+	}{
+		{"levi_db_pool_hits_total", "Connections found in the pool.", pool.Hits},
+		{"levi_db_pool_misses_total", "Connections not found in the pool.", pool.Misses},
+		{"levi_db_pool_timeouts_total", "Waits for a connection that timed out.", pool.Timeouts},
+	} {
+		header(b, c.name, "counter", c.help)
+		fmt.Fprintf(b, "%s %d\n", c.name, c.value)
+	}
+
+	header(b, "levi_db_pool_connections", "gauge", "Connections in the pool, by state.")
+	fmt.Fprintf(b, "levi_db_pool_connections{state=\"total\"} %d\n", pool.TotalConns)
+	fmt.Fprintf(b, "levi_db_pool_connections{state=\"idle\"} %d\n", pool.IdleConns)
+	fmt.Fprintf(b, "levi_db_pool_connections{state=\"stale\"} %d\n", pool.StaleConns)
+}
+
+// writeMigrations writes the versions as of the last migration,
+// so that a scrape never queries the database.
+func writeMigrations(b *bytes.Buffer, app *App) {
+	states, ok := app.migrated.Load().([]MigrationState)
+	if !ok {
+		return
+	}
+
+	header(b, "levi_migration_version", "gauge", "Migrated version of the table.")
+	for _, st := range states {
+		fmt.Fprintf(b, "levi_migration_version{table=\"%s\"} %d\n", escapeLabel(st.Table), st.Current)
+	}
+
+	header(b, "levi_migration_latest_version", "gauge", "Version of the table's model.")
+	for _, st := range states {
+		fmt.Fprintf(b, "levi_migration_latest_version{table=\"%s\"} %d\n", escapeLabel(st.Table), st.Latest)
+	}
+}
+
+func header(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(b *bytes.Buffer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cumulative uint64
+	for i, le := range buckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n",
+			name, labels, sep, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
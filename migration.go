@@ -3,7 +3,10 @@ package levi
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
@@ -15,107 +18,486 @@ type Migrant interface {
 	Up(*Migration) error
 }
 
+// Demigrant is a migrant that is also capable of rolling back.
+type Demigrant interface {
+	Migrant
+	Down(*Migration) error
+}
+
 // Migration is a special transaction type that gets called by
 // the migrant model whenever it needs to migrate.
+//
+// Every migration is a single step: when migrating up, To is the
+// version being migrated to and From is the one before it; when
+// migrating down, From is the version being rolled back.
 type Migration struct {
 	*pg.Tx
 	From, To int
 }
 
 // Up is called in the Migration function to simplify the outline
-// of the up-migration list.
+// of the up-migration list. The migrations call Up one version at
+// a time, each followed by its script, if any, so the versions
+// don't fall through:
 //
 //		v := mi.Up()
-//		switch {
-//		case v(1):
+//		if v(1) {
 //			mi.Exec("...")
-//			fallthrough
-//		case v(2):
+//		}
+//		if v(2) {
 //			// ...
 //		}
 //
 func (mi *Migration) Up() func(int) bool {
 	return func(v int) bool {
-		return v > mi.From
+		return v > mi.From && v <= mi.To
 	}
 }
 
 // Down is called in the Migration function to simplify the outline
-// of the down-migration list.
+// of the down-migration list. MigrateDown calls Down one version
+// at a time, each right after its script, if any:
+//
+//		v := mi.Down()
+//		if v(2) {
+//			mi.Exec("...")
+//		}
+//		if v(1) {
+//			// ...
+//		}
+//
 func (mi *Migration) Down() func(int) bool {
 	return func(v int) bool {
-		return v > mi.To
+		return v > mi.To && v <= mi.From
 	}
 }
 
+// MigrationState is the migration status of a single table.
+type MigrationState struct {
+	Table   string
+	Current int // stored in migrations
+	Latest  int // Version() of the model
+}
+
+func (st MigrationState) Pending() bool {
+	return st.Current < st.Latest
+}
+
 type tableVersion struct {
-	tableName struct{} `pg:"migrations"`
+	tableName struct{} `sql:"migrations"`
 
-	Table   string
-	Version int
+	Table      string `sql:",pk"`
+	Version    int    `sql:",notnull"`
+	MigratedAt time.Time
+}
+
+// Migrate is the entry point for the migrate subcommand
+// of the default app. It connects to the database on its own:
+//
+//	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+//		err := levi.Migrate(cfg, os.Args[2:]...)
+//	}
+//
+// See App.Migrate for the commands.
+func Migrate(cfg *Config, args ...string) error {
+	if err := std.configure(cfg); err != nil {
+		return err
+	}
+
+	return std.Migrate(args...)
+}
+
+// Migrate runs a migration command:
+//
+//	up                      migrate every table up to its version
+//	down <table> <version>  roll the table back to the version
+//	status                  print the stored and latest versions
+//	dry-run                 print the up-migration without committing
+//	generate <table> [sql]  emit the next migration, see App.Generate
+//	generate <table> go
+//
+func (app *App) Migrate(args ...string) error {
+	if len(args) == 0 {
+		return ErrBadCommand
+	}
+
+	// generating is a matter of the models and the snapshots
+	switch cmd := args[0]; {
+	case cmd == "generate" && len(args) == 2:
+		return app.Generate(args[1], "sql")
+
+	case cmd == "generate" && len(args) == 3:
+		return app.Generate(args[1], args[2])
+	}
+
+	if app.db == nil {
+		conn, err := openDatabase(&app.cfg)
+		if err != nil {
+			return err
+		}
+		app.db = conn
+		defer func() {
+			app.db.Close()
+			app.db = nil
+		}()
+	}
+
+	switch cmd := args[0]; {
+	case cmd == "up" && len(args) == 1:
+		return app.MigrateUp()
+
+	case cmd == "down" && len(args) == 3:
+		version, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("%w: bad version %q", ErrBadCommand, args[2])
+		}
+		return app.MigrateDown(args[1], version)
+
+	case cmd == "status" && len(args) == 1:
+		states, err := app.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("MIGRATIONS\n\n")
+		for _, st := range states {
+			info := ""
+			if st.Pending() {
+				info = " (pending)"
+			}
+			fmt.Printf("%8s %s v%d/%d%s\n", "TABLE", st.Table, st.Current, st.Latest, info)
+		}
+		fmt.Println()
+		return nil
+
+	case cmd == "dry-run" && len(args) == 1:
+		return app.MigrateDryRun()
+
+	default:
+		return fmt.Errorf("%w: %s", ErrBadCommand, strings.Join(args, " "))
+	}
+}
+
+// MigrateUp brings every versioned table up to its Version(),
+// recording the progress in the migrations table.
+func (app *App) MigrateUp() error {
+	if err := app.migrateUp(false); err != nil {
+		return err
+	}
+	return app.rememberMigrations()
+}
+
+// MigrateDryRun prints the queries of the up-migration and
+// rolls the transaction back.
+func (app *App) MigrateDryRun() error {
+	err := app.migrateUp(true)
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
+
+var errDryRun = ø("dry run")
+
+func (app *App) migrateUp(dry bool) error {
+	// a copy, so that the hook doesn't stick
+	conn := app.migrator()
+	if dry {
+		conn.AddQueryHook(queryPrinter{})
+	}
+
+	return conn.RunInTransaction(func(tx *pg.Tx) error {
+		// within the transaction, so that a dry run leaves
+		// no migrations table behind
+		version, err := storedVersions(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, model := range app.tables {
+			migrant, ok := model.(Migrant)
+			if !ok {
+				continue
+			}
+
+			table := tableName(model)
+			from, to := version[table], migrant.Version()
+			if from >= to {
+				continue
+			}
+
+			if dry {
+				fmt.Printf("-- %s v%d -> v%d\n", table, from, to)
+			}
+
+			if err := app.migrateTable(tx, model, table, from, to); err != nil {
+				return &MigrationError{model, err, ""}
+			}
+
+			if err := recordVersion(tx, table, to); err != nil {
+				return &MigrationError{model, err, "INSERT INTO migrations"}
+			}
+		}
+
+		if dry {
+			return errDryRun
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown rolls the table back to the version, running
+// the down scripts, if any, and Down, if the model is Demigrant;
+// a model with neither is ErrNotDemigrant.
+func (app *App) MigrateDown(table string, version int) error {
+	var model Model
+	for _, m := range app.tables {
+		if tableName(m) == table {
+			model = m
+		}
+	}
+
+	if model == nil {
+		return fmt.Errorf("%w: unknown table %s", ErrBadCommand, table)
+	}
+
+	stored, err := storedVersions(app.db)
+	if err != nil {
+		return err
+	}
+
+	from := stored[table]
+	if version >= from {
+		return nil
+	}
+
+	if _, ok := model.(Demigrant); !ok && !app.hasDownScripts(table, from, version) {
+		return fmt.Errorf("%w: %s", ErrNotDemigrant, table)
+	}
+
+	err = app.migrator().RunInTransaction(func(tx *pg.Tx) error {
+		if err := app.migrateTable(tx, model, table, from, version); err != nil {
+			return &MigrationError{model, err, ""}
+		}
+
+		if err := recordVersion(tx, table, version); err != nil {
+			return &MigrationError{model, err, "INSERT INTO migrations"}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.rememberMigrations()
+}
+
+// rememberMigrations keeps the migration status for the metrics.
+func (app *App) rememberMigrations() error {
+	states, err := app.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	app.migrated.Store(states)
+	return nil
+}
+
+// MigrationStatus reports the stored and the latest versions
+// of every versioned table.
+func (app *App) MigrationStatus() ([]MigrationState, error) {
+	version, err := storedVersions(app.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, model := range app.tables {
+		migrant, ok := model.(Migrant)
+		if !ok || migrant.Version() == 0 {
+			continue
+		}
+
+		table := tableName(model)
+		states = append(states, MigrationState{table, version[table], migrant.Version()})
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Table < states[j].Table
+	})
+
+	return states, nil
 }
 
-func migrateUp() error {
+// migrationsTable creates the migrations table, or brings the
+// one of an older levi, a mere ("table", version), up to date.
+const migrationsTable = `CREATE TABLE IF NOT EXISTS migrations (
+	"table" text PRIMARY KEY,
+	version bigint NOT NULL,
+	migrated_at timestamptz
+);
+ALTER TABLE migrations ADD COLUMN IF NOT EXISTS migrated_at timestamptz;
+CREATE UNIQUE INDEX IF NOT EXISTS migrations_table_key ON migrations ("table")`
+
+func storedVersions(db orm.DB) (map[string]int, error) {
+	if _, err := db.Exec(migrationsTable); err != nil {
+		return nil, &MigrationError{nil, err, migrationsTable}
+	}
+
 	var versions []tableVersion
-	if err := db.Select(&versions); err != nil {
-		return &MigrationError{nil, err, "SELECT * FROM migrations"}
+	if err := db.Model(&versions).Select(); err != nil {
+		return nil, &MigrationError{nil, err, "SELECT * FROM migrations"}
 	}
+
 	version := map[string]int{}
 	for _, t := range versions {
 		version[t.Table] = t.Version
 	}
 
-	return db.RunInTransaction(func(tx *pg.Tx) error {
-		for _, model := range tables {
-			migrant := model.(Migrant)
-			tableName := tableOf(model).Name
+	return version, nil
+}
+
+// migrateTable migrates the table one version at a time, either
+// way: up, Up of the version goes first and its script second;
+// down, the script goes first and Down, if any, second.
+func (app *App) migrateTable(tx *pg.Tx, model Model, table string, from, to int) error {
+	for v := from + 1; v <= to; v++ {
+		if migrant, ok := model.(Migrant); ok {
+			if err := migrant.Up(&Migration{Tx: tx, From: v - 1, To: v}); err != nil {
+				return err
+			}
+		}
+		if err := app.runScript(tx, table, v, "up"); err != nil {
+			return err
+		}
+	}
 
-			mi := &Migration{Tx: tx, From: version[tableName]}
-			if err := migrant.Up(mi); err != nil {
-				return &MigrationError{model, err, ""}
+	for v := from; v > to; v-- {
+		if err := app.runScript(tx, table, v, "down"); err != nil {
+			return err
+		}
+		if demigrant, ok := model.(Demigrant); ok {
+			if err := demigrant.Down(&Migration{Tx: tx, From: v, To: v - 1}); err != nil {
+				return err
 			}
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func autoMigrate(model Model) error {
+// migrator is a copy of the database without the query
+// timeout, as the migrations may well take longer.
+func (app *App) migrator() *pg.DB {
+	return app.db.WithTimeout(0)
+}
+
+// queryPrinter prints out every query, for dry runs.
+type queryPrinter struct{}
+
+func (queryPrinter) BeforeQuery(*pg.QueryEvent) {}
+
+func (queryPrinter) AfterQuery(ev *pg.QueryEvent) {
+	if query, err := ev.FormattedQuery(); err == nil {
+		fmt.Println(query + ";")
+	}
+}
+
+func recordVersion(tx *pg.Tx, table string, version int) error {
+	_, err := tx.Model(&tableVersion{
+		Table:      table,
+		Version:    version,
+		MigratedAt: time.Now(),
+	}).OnConflict(`("table") DO UPDATE`).
+		Set("version = EXCLUDED.version, migrated_at = EXCLUDED.migrated_at").
+		Insert()
+	return err
+}
+
+// autoMigration is what autoMigrate has done to a table.
+type autoMigration struct {
+	Table   string
+	Created bool
+	Columns []string // added
+}
+
+// autoMigrateAll auto-migrates every versionless table.
+func (app *App) autoMigrateAll() ([]autoMigration, error) {
+	var done []autoMigration
+	for _, model := range app.tables {
+		if migrant, ok := model.(Migrant); ok && migrant.Version() != 0 {
+			continue
+		}
+
+		am, err := app.autoMigrate(model)
+		if err != nil {
+			return nil, err
+		}
+
+		if am.Created || len(am.Columns) != 0 {
+			done = append(done, *am)
+		}
+	}
+
+	return done, nil
+}
+
+func (app *App) autoMigrate(model Model) (*autoMigration, error) {
 	if model.Type() != TABLE {
-		return ErrBadArchetype
+		return nil, ErrBadArchetype
 	}
 
-	return db.RunInTransaction(func(tx *pg.Tx) error {
-		err := tx.CreateTable(model, &orm.CreateTableOptions{IfNotExists: true})
+	table := tableOf(model)
+	schema, name := tableSchema(model)
+	am := &autoMigration{Table: tableName(model)}
+
+	return am, app.migrator().RunInTransaction(func(tx *pg.Tx) error {
+		var existing []string
+		_, err := tx.Query(&existing, `SELECT column_name FROM information_schema.columns
+	WHERE table_schema = coalesce(nullif(?, ''), current_schema()) AND table_name = ?`, schema, name)
 		if err != nil {
-			return &MigrationError{model, err, "CREATE TABLE IF NOT EXISTS"}
+			return &MigrationError{model, err, "SELECT FROM information_schema.columns"}
 		}
 
-		table := tableOf(model)
-		columns := make([]string, 0, len(table.Fields))
-		for _, field := range table.Fields {
-			columns = append(columns, `"`+field.SQLName+`" `+field.SQLType)
+		if len(existing) == 0 {
+			err := tx.CreateTable(model, &orm.CreateTableOptions{IfNotExists: true})
+			if err != nil {
+				return &MigrationError{model, err, "CREATE TABLE IF NOT EXISTS"}
+			}
+
+			am.Created = true
+			return nil
 		}
 
-		for i, column := range columns {
-			query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
-				table.Name, column)
+		has := map[string]bool{}
+		for _, column := range existing {
+			has[column] = true
+		}
 
-			defaultExpr := table.Fields[i].Default
-			if defaultExpr != "" {
-				query += " DEFAULT (" + string(defaultExpr) + ")"
+		for _, field := range table.Fields {
+			if has[field.SQLName] {
+				continue
 			}
 
-			if pgTag, ok := table.Fields[i].Field.Tag.Lookup("pg"); ok {
-				if strings.Contains(pgTag, "notnull") {
-					query += " NOT NULL"
-				}
+			query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+				table.FullName, field.Column, field.SQLType)
+
+			if field.Default != "" {
+				query += " DEFAULT (" + string(field.Default) + ")"
+			}
+
+			if field.HasFlag(orm.NotNullFlag) {
+				query += " NOT NULL"
 			}
 
 			_, err := tx.Exec(query)
 			if err != nil {
 				return &MigrationError{model, err, query}
 			}
+
+			am.Columns = append(am.Columns, field.SQLName)
 		}
 
 		return nil
@@ -125,3 +507,48 @@ func autoMigrate(model Model) error {
 func tableOf(model Model) *orm.Table {
 	return orm.GetTable(reflect.TypeOf(model).Elem())
 }
+
+// tableName is the unquoted name of the model's table, as in
+// users, or app.users for the schema-qualified "app"."users".
+func tableName(model Model) string {
+	return strings.Join(splitIdent(string(tableOf(model).FullName)), ".")
+}
+
+// tableSchema is the schema the model's table is in, or ""
+// for the current one, along with the bare table name.
+func tableSchema(model Model) (schema, name string) {
+	parts := splitIdent(string(tableOf(model).FullName))
+	name = parts[len(parts)-1]
+	if len(parts) > 1 {
+		schema = parts[len(parts)-2]
+	}
+	return schema, name
+}
+
+// splitIdent splits a possibly qualified SQL name into its
+// unquoted parts: "app"."a ""b""" is app and a "b".
+func splitIdent(ident string) []string {
+	var (
+		parts  []string
+		part   strings.Builder
+		quoted bool
+	)
+
+	for i := 0; i < len(ident); i++ {
+		c := ident[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(ident) && ident[i+1] == '"':
+			part.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+
+	return append(parts, part.String())
+}
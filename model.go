@@ -11,6 +11,11 @@ import (
 // because it's When the migration happens.
 //
 func Register(models ...Model) {
+	std.Register(models...)
+}
+
+// Register makes the app aware of the models, see Register.
+func (app *App) Register(models ...Model) {
 	for _, model := range models {
 		if model == nil {
 			panic(ErrNilModel)
@@ -18,11 +23,21 @@ func Register(models ...Model) {
 
 		switch model.Type() {
 		case TABLE:
-			tables = append(tables, model)
+			app.tables = append(app.tables, model)
 		case QUEUE:
-			cues = append(cues, model)
+			if _, ok := model.(Worker); !ok {
+				panic(fmt.Errorf("%w: %T", ErrNotWorker, model))
+			}
+			app.cues = append(app.cues, model)
 		case GRAPH:
-			graphs = append(graphs, model)
+			vertex, ok := model.(Vertex)
+			if !ok {
+				panic(fmt.Errorf("%w: %T", ErrNotVertex, model))
+			}
+			if err := claimClass(vertex); err != nil {
+				panic(err)
+			}
+			app.graphs = append(app.graphs, model)
 		default:
 			panic(fmt.Errorf("%w: %T", ErrBadArchetype, model))
 		}
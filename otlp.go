@@ -0,0 +1,309 @@
+package levi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPTracer exports the spans to an OpenTelemetry collector,
+// using OTLP/HTTP with the JSON encoding.
+//
+// Spans are batched and posted in the background; the ones that
+// fail to get through are dropped, so a collector that is down
+// never takes the app along.
+type OTLPTracer struct {
+	// Endpoint of the collector, as in http://localhost:4318;
+	// spans are posted to Endpoint/v1/traces.
+	Endpoint string
+
+	// The service.name of the spans.
+	//
+	// Default: Config.ApplicationName.
+	Service string
+
+	// Headers sent along, e.g. the collector's API key.
+	Headers map[string]string
+
+	// The number of spans posted at once.
+	//
+	// Default: 512.
+	Batch int
+
+	// How often the incomplete batches get posted.
+	//
+	// Default: 5 seconds.
+	FlushEvery time.Duration
+
+	// Default: a client with a 10 second timeout.
+	Client *http.Client
+
+	mu      sync.Mutex
+	spans   []*Span
+	closed  bool
+	posting sync.WaitGroup
+	once    sync.Once
+	ticker  *time.Ticker
+	stop    chan struct{}
+}
+
+func (o *OTLPTracer) start() {
+	if o.Service == "" {
+		o.Service = "levi"
+	}
+	if o.Batch <= 0 {
+		o.Batch = 512
+	}
+	if o.FlushEvery <= 0 {
+		o.FlushEvery = 5 * time.Second
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	o.stop = make(chan struct{})
+	o.ticker = time.NewTicker(o.FlushEvery)
+	go o.flushEvery()
+}
+
+func (o *OTLPTracer) flushEvery() {
+	for {
+		select {
+		case <-o.ticker.C:
+			o.post(o.take(1))
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+func (o *OTLPTracer) Export(span *Span) error {
+	o.once.Do(o.start)
+
+	o.mu.Lock()
+	o.spans = append(o.spans, span)
+	o.mu.Unlock()
+
+	if batch := o.take(o.Batch); batch != nil {
+		o.posting.Add(1)
+		go func() {
+			defer o.posting.Done()
+			o.post(batch)
+		}()
+	}
+
+	return nil
+}
+
+// take empties the buffer, given there are at least n spans.
+func (o *OTLPTracer) take(n int) []*Span {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.spans) < n {
+		return nil
+	}
+
+	spans := o.spans
+	o.spans = nil
+	return spans
+}
+
+func (o *OTLPTracer) post(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := o.send(spans); err != nil {
+		fmt.Printf("TRACER DROPPED %d SPANS: %v\n", len(spans), err)
+	}
+}
+
+func (o *OTLPTracer) send(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(o.Service, spans))
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(o.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", res.Status)
+	}
+
+	return nil
+}
+
+// Flush posts the buffered spans, and waits for the ones
+// in flight. Wake calls it on shutdown.
+func (o *OTLPTracer) Flush() error {
+	o.once.Do(o.start)
+
+	spans := o.take(1)
+	o.posting.Wait()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	return o.send(spans)
+}
+
+// Close flushes the tracer and stops posting the incomplete
+// batches; the spans that come in later are posted by the full
+// batch, or by Flush. Wake calls it on shutdown.
+func (o *OTLPTracer) Close() error {
+	o.once.Do(o.start)
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.mu.Unlock()
+
+	close(o.stop)
+	o.ticker.Stop()
+	return o.Flush()
+}
+
+// OTLP/JSON, as in opentelemetry-proto; ids are hex,
+// the 64-bit integers are strings.
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         SpanKind    `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Events       []otlpEvent `json:"events,omitempty"`
+	Status       otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	Time       string     `json:"timeUnixNano"`
+	Name       string     `json:"name"`
+	Attributes []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpRequest(service string, spans []*Span) interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:      s.Trace,
+			SpanID:       s.Id,
+			ParentSpanID: s.Parent,
+			Name:         s.Name,
+			Kind:         s.Kind,
+			Start:        nanos(s.Started),
+			End:          nanos(s.Ended),
+			Attributes:   otlpAttrs(s.Attrs),
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{2, s.Err.Error()}
+		}
+
+		for _, log := range s.Logs {
+			attrs := otlpAttrs(log.With)
+			attrs = append(attrs, otlpAttr{"message", otlpValue(log.Message())})
+			if log.Job != "" {
+				attrs = append(attrs, otlpAttr{"job", otlpValue(log.Job)})
+			}
+			span.Events = append(span.Events, otlpEvent{
+				Time:       nanos(s.Started.Add(log.When)),
+				Name:       log.How.Level(),
+				Attributes: attrs,
+			})
+		}
+
+		out = append(out, span)
+	}
+
+	resource := map[string]interface{}{
+		"attributes": []otlpAttr{{"service.name", otlpValue(service)}},
+	}
+	scope := map[string]interface{}{
+		"scope": map[string]string{"name": "levi"},
+		"spans": out,
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource":   resource,
+				"scopeSpans": []interface{}{scope},
+			},
+		},
+	}
+}
+
+func otlpAttrs(kv Kv) []otlpAttr {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttr, 0, len(kv))
+	for _, k := range keys {
+		attrs = append(attrs, otlpAttr{k, otlpValue(kv[k])})
+	}
+	return attrs
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,285 @@
+package levi
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow is what AsyncLogger does when its buffer is full.
+type Overflow int
+
+const (
+	// BLOCK waits for the room in the buffer.
+	BLOCK Overflow = iota
+	// DROP drops the reports with nothing worse than a WARNING;
+	// the ones with errors and panics still wait.
+	DROP
+	// SAMPLE keeps one report out of SampleEvery, dropping
+	// the rest; the kept ones wait.
+	SAMPLE
+)
+
+// AsyncLogger hands the finished requests over to the sink in
+// the background, so that a slow sink never holds a response.
+//
+// Reports are snapshots, so the sink may take its time: echo
+// recycles the request context as soon as the handler returns.
+type AsyncLogger struct {
+	// Default: &StdLogger{}.
+	Sink Logger
+
+	// The number of reports waiting for the sink.
+	//
+	// Default: 1024.
+	Buffer int
+
+	// The number of goroutines feeding the sink.
+	//
+	// Default: 1.
+	Workers int
+
+	// What to do once the buffer is full.
+	//
+	// Default: BLOCK.
+	Overflow Overflow
+
+	// For the SAMPLE overflow policy.
+	//
+	// Default: 10.
+	SampleEvery int
+
+	// How often the sink gets flushed, if it's a Flusher.
+	//
+	// Default: 1 second.
+	FlushEvery time.Duration
+
+	reports chan *Lv
+	once    sync.Once
+	dropped uint64
+	sampled uint64
+
+	// guards the reports on their way to the sink, and the
+	// failure of the background flush, if any
+	mu      sync.Mutex
+	idle    *sync.Cond
+	pending int
+	closed  bool
+	failed  error
+	ticker  *time.Ticker
+	stop    chan struct{}
+}
+
+func (a *AsyncLogger) start() {
+	if a.Sink == nil {
+		a.Sink = &StdLogger{}
+	}
+	if a.Buffer <= 0 {
+		a.Buffer = 1024
+	}
+	if a.Workers <= 0 {
+		a.Workers = 1
+	}
+	if a.SampleEvery <= 0 {
+		a.SampleEvery = 10
+	}
+	if a.FlushEvery <= 0 {
+		a.FlushEvery = time.Second
+	}
+
+	a.idle = sync.NewCond(&a.mu)
+	a.stop = make(chan struct{})
+	a.reports = make(chan *Lv, a.Buffer)
+	for i := 0; i < a.Workers; i++ {
+		go a.work()
+	}
+
+	if flusher, ok := a.Sink.(Flusher); ok {
+		a.ticker = time.NewTicker(a.FlushEvery)
+		go a.flushEvery(flusher)
+	}
+}
+
+func (a *AsyncLogger) work() {
+	for lv := range a.reports {
+		// the sink has failed the report, so it's as good
+		// as dropped
+		if err := a.Sink.Report(lv); err != nil {
+			atomic.AddUint64(&a.dropped, 1)
+		}
+		a.done()
+	}
+}
+
+// flushEvery flushes the sink until Close; the failure is
+// kept for the next Flush to return.
+func (a *AsyncLogger) flushEvery(flusher Flusher) {
+	for {
+		select {
+		case <-a.ticker.C:
+			if err := flusher.Flush(); err != nil {
+				a.mu.Lock()
+				if a.failed == nil {
+					a.failed = err
+				}
+				a.mu.Unlock()
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *AsyncLogger) Report(lv *Lv) error {
+	a.once.Do(a.start)
+
+	snap := lv.snapshot()
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return a.Sink.Report(snap)
+	}
+	a.pending++
+	a.mu.Unlock()
+
+	select {
+	case a.reports <- snap:
+		return nil
+	default:
+	}
+
+	switch a.Overflow {
+	case DROP:
+		if snap.Worst() < ERROR {
+			a.drop()
+			return nil
+		}
+	case SAMPLE:
+		if atomic.AddUint64(&a.sampled, 1)%uint64(a.SampleEvery) != 0 {
+			a.drop()
+			return nil
+		}
+	}
+
+	a.reports <- snap
+	return nil
+}
+
+func (a *AsyncLogger) drop() {
+	atomic.AddUint64(&a.dropped, 1)
+	a.done()
+}
+
+func (a *AsyncLogger) done() {
+	a.mu.Lock()
+	if a.pending--; a.pending == 0 {
+		a.idle.Broadcast()
+	}
+	a.mu.Unlock()
+}
+
+// Dropped is the number of reports dropped on overflow, or
+// failed by the sink, so far.
+func (a *AsyncLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Flush waits for the buffered reports to reach the sink,
+// and flushes the sink itself.
+func (a *AsyncLogger) Flush() error {
+	a.once.Do(a.start)
+
+	a.mu.Lock()
+	for a.pending > 0 {
+		a.idle.Wait()
+	}
+	failed := a.failed
+	a.failed = nil
+	a.mu.Unlock()
+
+	if flusher, ok := a.Sink.(Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return failed
+}
+
+// Close flushes the logger and stops its goroutines; the
+// reports that come in later go straight to the sink. Wake
+// calls it on shutdown.
+func (a *AsyncLogger) Close() error {
+	a.once.Do(a.start)
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	err := a.Flush()
+
+	close(a.stop)
+	if a.ticker != nil {
+		a.ticker.Stop()
+	}
+	close(a.reports)
+	return err
+}
+
+// MultiLogger fans every report out to all of the loggers,
+// e.g. stdout and a file.
+func MultiLogger(loggers ...Logger) Logger {
+	return multiLogger(loggers)
+}
+
+type multiLogger []Logger
+
+func (m multiLogger) Report(lv *Lv) error {
+	var first error
+	for _, logger := range m {
+		if err := logger.Report(lv); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m multiLogger) Flush() error {
+	var first error
+	for _, logger := range m {
+		if flusher, ok := logger.(Flusher); ok {
+			if err := flusher.Flush(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (m multiLogger) Close() error {
+	var first error
+	for _, logger := range m {
+		if err := closeLogger(logger); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// closeLogger closes the logger, if it's an io.Closer, or
+// flushes it, if it's a Flusher.
+func closeLogger(logger interface{}) error {
+	switch logger := logger.(type) {
+	case io.Closer:
+		return logger.Close()
+	case Flusher:
+		return logger.Flush()
+	}
+	return nil
+}
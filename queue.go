@@ -0,0 +1,355 @@
+package levi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Queue is the base of every QUEUE model.
+//
+// The model itself is the job payload: it gets marshalled
+// into JSON on Enqueue and unmarshalled into a fresh value
+// right before its Work method is called.
+//
+//	type Email struct {
+//		levi.Queue
+//		To, Subject string
+//	}
+//
+//	func (e *Email) Work(job *levi.Job) error {
+//		return send(e.To, e.Subject)
+//	}
+//
+type Queue struct{}
+
+func (Queue) Type() Archetype     { return QUEUE }
+func (Queue) Policy() QueuePolicy { return QueuePolicy{} } // defaults
+
+// Worker is a QUEUE model that knows how to process itself.
+type Worker interface {
+	Model
+	Work(*Job) error
+}
+
+// QueuePolicy tells the workers how to treat the queue.
+//
+// Models override it by declaring their own Policy() method.
+type QueuePolicy struct {
+	// Number of jobs processed simultaneously.
+	//
+	// Default: 1.
+	Concurrency int
+
+	// Number of attempts before the job is dead-lettered.
+	//
+	// Default: 5.
+	MaxAttempts int
+
+	// The period during which a claimed job is invisible to
+	// the other workers; if the worker doesn't finish in time,
+	// the job is claimed again.
+	//
+	// Default: 1 minute.
+	Visibility time.Duration
+
+	// Backoff is the delay before the next attempt.
+	//
+	// Default: exponential, starting from one second.
+	Backoff func(attempt int) time.Duration
+}
+
+// policed is a QUEUE model with a policy, which every model
+// embedding Queue is; the rest get the defaults.
+type policed interface {
+	Policy() QueuePolicy
+}
+
+// Job is a single claimed queue entry.
+type Job struct {
+	Id      int64
+	Queue   string
+	Attempt int
+}
+
+// Enqueue puts the job onto its postgres queue.
+//
+// Pass a *pg.Tx to enqueue transactionally: the job becomes
+// visible to the workers only once the transaction commits.
+// Optional time postpones the job.
+func Enqueue(tx orm.DB, job Worker, at ...time.Time) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("levi: failure to marshal %T: %w", job, err)
+	}
+
+	runAt := time.Now()
+	if len(at) == 1 {
+		runAt = at[0]
+	}
+
+	name := queueName(job)
+	_, err = tx.Exec(`INSERT INTO ? (payload, run_at) VALUES (?, ?)`,
+		pg.F(name), string(payload), runAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify(?, '')`, name)
+	return err
+}
+
+// Enqueue puts the job onto its postgres queue.
+//
+// Within the atomic paperwork, the job is enqueued in its
+// transaction.
+func (lv *Lv) Enqueue(job Worker, at ...time.Time) error {
+	if tx := lv.Tx(); tx != nil {
+		return Enqueue(tx, job, at...)
+	}
+	return Enqueue(lv.app.db.WithContext(lv.Ctx()), job, at...)
+}
+
+// queuePoll is how often the workers look for jobs that were
+// postponed, retried or abandoned; fresh jobs are announced
+// with NOTIFY instead.
+const queuePoll = 5 * time.Second
+
+type queue struct {
+	app    *App
+	db     *pg.DB
+	name   string
+	typ    reflect.Type
+	policy QueuePolicy
+	wake   chan struct{}
+}
+
+func newQueue(app *App, model Model) *queue {
+	var policy QueuePolicy
+	if p, ok := model.(policed); ok {
+		policy = p.Policy()
+	}
+	if policy.Concurrency <= 0 {
+		policy.Concurrency = 1
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 5
+	}
+	if policy.Visibility <= 0 {
+		policy.Visibility = time.Minute
+	}
+	if policy.Backoff == nil {
+		policy.Backoff = backoff
+	}
+
+	return &queue{
+		app:    app,
+		db:     app.db,
+		name:   queueName(model),
+		typ:    reflect.TypeOf(model).Elem(),
+		policy: policy,
+		wake:   make(chan struct{}, policy.Concurrency),
+	}
+}
+
+func queueName(model Model) string {
+	return "queue_" + orm.GetTable(reflect.TypeOf(model).Elem()).ModelName
+}
+
+func backoff(attempt int) time.Duration {
+	if attempt > 16 {
+		attempt = 16
+	}
+	return time.Second << uint(attempt-1)
+}
+
+// createQueues makes sure every registered queue has its table.
+func (app *App) createQueues() error {
+	for _, model := range app.cues {
+		name := queueName(model)
+		query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	payload jsonb NOT NULL,
+	attempts int NOT NULL DEFAULT 0,
+	run_at timestamptz NOT NULL DEFAULT now(),
+	locked_until timestamptz,
+	dead_at timestamptz,
+	error text,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS %[1]s_ready ON %[1]s (run_at, id) WHERE dead_at IS NULL`, name)
+
+		if _, err := app.db.Exec(query); err != nil {
+			return &MigrationError{model, err, query}
+		}
+	}
+
+	return nil
+}
+
+// startQueues spawns the listener and the workers of every queue.
+//
+// Once quit is closed, the workers finish their current jobs
+// and leave the wait group.
+func (app *App) startQueues(quit <-chan struct{}, wg *sync.WaitGroup) {
+	for _, model := range app.cues {
+		q := newQueue(app, model)
+		go q.listen(quit)
+		for i := 0; i < q.policy.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q.work(quit)
+			}()
+		}
+	}
+}
+
+func (q *queue) listen(quit <-chan struct{}) {
+	ln := q.db.Listen(q.name)
+	go func() {
+		<-quit
+		ln.Close()
+	}()
+
+	for range ln.Channel() {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *queue) work(quit <-chan struct{}) {
+	poll := time.NewTicker(queuePoll)
+	defer poll.Stop()
+
+	for {
+		for q.next() {
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-q.wake:
+		case <-poll.C:
+		}
+	}
+}
+
+// next claims a single job and processes it, reporting whether
+// there was anything to claim.
+func (q *queue) next() bool {
+	const claim = `UPDATE ?0 SET attempts = attempts + 1,
+	locked_until = now() + ?1 * interval '1 millisecond'
+WHERE id = (
+	SELECT id FROM ?0
+	WHERE dead_at IS NULL AND run_at <= now()
+		AND (locked_until IS NULL OR locked_until < now())
+	ORDER BY run_at, id
+	FOR UPDATE SKIP LOCKED
+	LIMIT 1
+)
+RETURNING id, payload, attempts`
+
+	job := &Job{Queue: q.name}
+	var payload string
+
+	_, err := q.db.QueryOne(pg.Scan(&job.Id, &payload, &job.Attempt), claim,
+		pg.F(q.name), q.policy.Visibility.Milliseconds())
+	if err == pg.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		q.report("claim", ERROR, "levi: failure to claim a job: %v", err)
+		return false
+	}
+
+	if err = q.process(job, payload); err == nil {
+		_, err = q.db.Exec(`DELETE FROM ? WHERE id = ?`, pg.F(q.name), job.Id)
+	} else {
+		err = q.fail(job, err)
+	}
+
+	if err != nil {
+		q.report(jobName(job), ERROR, "levi: failure to settle the job: %v", err)
+	}
+
+	return true
+}
+
+func (q *queue) process(job *Job, payload string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	model := reflect.New(q.typ).Interface().(Worker)
+	if err := json.Unmarshal([]byte(payload), model); err != nil {
+		return err
+	}
+
+	return model.Work(job)
+}
+
+// fail either schedules a retry, or dead-letters the job once
+// it runs out of attempts. Dead jobs stay in the table with
+// dead_at set, so they can be inspected and requeued by hand.
+func (q *queue) fail(job *Job, cause error) error {
+	if job.Attempt >= q.policy.MaxAttempts {
+		q.report(jobName(job), ERROR, "levi: attempt %d of %d failed, dead: %v",
+			job.Attempt, q.policy.MaxAttempts, cause)
+
+		_, err := q.db.Exec(`UPDATE ? SET dead_at = now(), locked_until = NULL,
+	error = ? WHERE id = ?`, pg.F(q.name), cause.Error(), job.Id)
+		return err
+	}
+
+	q.report(jobName(job), WARNING, "levi: attempt %d of %d failed: %v",
+		job.Attempt, q.policy.MaxAttempts, cause)
+
+	runAt := time.Now().Add(q.policy.Backoff(job.Attempt))
+	_, err := q.db.Exec(`UPDATE ? SET run_at = ?, locked_until = NULL,
+	error = ? WHERE id = ?`, pg.F(q.name), runAt, cause.Error(), job.Id)
+	return err
+}
+
+// report logs the trouble with the queue through the app's
+// logger, the way the detached work is reported:
+//
+//	DETACHED job #17 FROM QUEUE queue_email ID queue_email-17 NOW ...
+//
+func (q *queue) report(what string, kind Logotype, format string, args ...interface{}) {
+	req := &http.Request{
+		Method: "QUEUE",
+		URL:    &url.URL{Path: q.name},
+		Header: http.Header{},
+	}
+
+	lv := &Lv{
+		Context:  q.app.router.NewContext(req, nil),
+		app:      q.app,
+		id:       q.name + "-" + strings.TrimPrefix(what, "job #"),
+		level:    q.app.level,
+		started:  time.Now(),
+		detached: what,
+	}
+	lv.logf(kind, format, args...)
+	lv.finished = time.Now()
+
+	q.app.logger.Report(lv)
+}
+
+func jobName(job *Job) string {
+	return fmt.Sprintf("job #%d", job.Id)
+}
@@ -1,41 +1,183 @@
 package levi
 
 import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
 	"runtime/debug"
 	"strings"
 
+	"github.com/go-pg/pg"
 	"github.com/labstack/echo"
 )
 
 // Echo provides access to application's main HTTP router.
 func Echo() *echo.Echo {
-	return router
+	return std.router
 }
 
-func newRouter() *echo.Echo {
+// Echo provides access to the app's HTTP router.
+func (app *App) Echo() *echo.Echo {
+	return app.router
+}
+
+func (app *App) newRouter() *echo.Echo {
 	e := echo.New()
-	e.Renderer = renderer
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) (err error) {
-			lv := &Lv{Context: c}
+		return func(c echo.Context) error {
+			// echo recycles its own context as soon as the
+			// handler returns, and the jobs may well outlive it
+			ctx := app.router.NewContext(c.Request(), c.Response())
+			ctx.SetPath(c.Path())
+			ctx.SetParamNames(append([]string(nil), c.ParamNames()...)...)
+			ctx.SetParamValues(append([]string(nil), c.ParamValues()...)...)
+			lv := &Lv{Context: ctx, app: app}
 
 			defer func(lv *Lv) {
 				if r := recover(); r != nil {
-					stack := string(debug.Stack())
-					stack = stack[strings.Index(stack, "panic("):]
+					app.metrics.panic()
+					stack := panicStack()
 					lv.Panicf("%s\n%s", r, stack)
-					err = lv.NoContent(403)
+					app.panicked(lv, r, stack)
 					lv.End(nil)
 				}
 			}(lv)
 
 			lv.Begin()
-			err = next(lv)
+			err := next(lv)
+			if err != nil {
+				app.handleError(lv, err)
+			}
 			lv.End(err)
 
-			return
+			return nil
 		}
 	})
 
 	return e
 }
+
+// ErrorMapper responds to the errors it recognises and
+// reports whether it did; the rest are passed on to the next
+// mapper and, eventually, to the default mapping:
+//
+//	*ValidationError  422, the error itself as JSON
+//	ErrBadPaperwork   400
+//	pg.ErrNoRows      404
+//	*MigrationError   500
+//	*echo.HTTPError   its own code
+//	anything else     500
+//
+// Errors are matched with errors.Is and errors.As, so they
+// may as well be wrapped.
+type ErrorMapper func(lv *Lv, err error) bool
+
+// MapErrors registers the error mappers with the default app.
+func MapErrors(mappers ...ErrorMapper) {
+	std.MapErrors(mappers...)
+}
+
+// MapErrors registers the error mappers, in order.
+func (app *App) MapErrors(mappers ...ErrorMapper) {
+	app.mappers = append(app.mappers, mappers...)
+}
+
+// StatusOf is the HTTP status an error is mapped to by default.
+func StatusOf(err error) int {
+	var (
+		validation *ValidationError
+		migration  *MigrationError
+		he         *echo.HTTPError
+	)
+
+	switch {
+	case errors.As(err, &validation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrBadPaperwork):
+		return http.StatusBadRequest
+	case errors.Is(err, pg.ErrNoRows):
+		return http.StatusNotFound
+	case errors.As(err, &migration):
+		return http.StatusInternalServerError
+	case errors.As(err, &he):
+		return he.Code
+	}
+
+	return http.StatusInternalServerError
+}
+
+// handleError responds to the error returned by the handler,
+// unless the handler has already responded.
+func (app *App) handleError(lv *Lv, err error) {
+	if lv.Response().Committed {
+		return
+	}
+
+	for _, mapper := range app.mappers {
+		if mapper(lv, err) {
+			return
+		}
+	}
+
+	status := StatusOf(err)
+	var body interface{} = echo.Map{"message": http.StatusText(status)}
+
+	var (
+		validation *ValidationError
+		he         *echo.HTTPError
+	)
+	switch {
+	case errors.As(err, &validation):
+		body = validation
+	case errors.As(err, &he):
+		body = echo.Map{"message": he.Message}
+	case app.IsDev():
+		body = echo.Map{"message": err.Error()}
+	}
+
+	if lv.Request().Method == http.MethodHead {
+		err = lv.NoContent(status)
+	} else {
+		err = lv.JSON(status, body)
+	}
+	if err != nil {
+		lv.Error(err)
+	}
+}
+
+// panicked responds to the recovered panic with a 500: the
+// stack page in dev, nothing to learn from in production.
+func (app *App) panicked(lv *Lv, r interface{}, stack string) {
+	if lv.Response().Committed {
+		return
+	}
+
+	var err error
+	if app.IsProd() {
+		err = lv.JSON(http.StatusInternalServerError,
+			echo.Map{"message": http.StatusText(http.StatusInternalServerError)})
+	} else {
+		err = lv.HTML(http.StatusInternalServerError, fmt.Sprintf(stackPage,
+			html.EscapeString(fmt.Sprint(r)), html.EscapeString(stack)))
+	}
+	if err != nil {
+		lv.Error(err)
+	}
+}
+
+const stackPage = `<!doctype html>
+<title>panic</title>
+<h1>panic: %s</h1>
+<pre>%s</pre>
+`
+
+// panicStack is the stack of the panicking goroutine,
+// starting from the panic.
+func panicStack() string {
+	stack := string(debug.Stack())
+	if i := strings.Index(stack, "panic("); i >= 0 {
+		stack = stack[i:]
+	}
+	return stack
+}
@@ -0,0 +1,205 @@
+package levi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// SpanKind is the OpenTelemetry kind of a span.
+type SpanKind int
+
+const (
+	// INTERNAL is an operation within the app: a job,
+	// a transaction or a graph operation.
+	INTERNAL SpanKind = iota + 1
+	// SERVER is the request itself.
+	SERVER
+	// CLIENT is a call to postgres.
+	CLIENT
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SERVER:
+		return "SERVER"
+	case CLIENT:
+		return "CLIENT"
+	}
+	return "INTERNAL"
+}
+
+// Span is a timed operation within a trace, in the OpenTelemetry
+// sense of the word: each request is a root span, its Lv.Go jobs,
+// transactions, queries and graph operations are the children.
+//
+// Spans are only recorded when the app has a Tracer, and the
+// incoming traceparent (if any) has the sampled flag; otherwise
+// they are nil, and every method is a no-op.
+type Span struct {
+	Trace  string // 32 hex
+	Id     string // 16 hex
+	Parent string // 16 hex, empty for the root span
+	Name   string
+	Kind   SpanKind
+
+	Started, Ended time.Time
+
+	// Attrs follow the OpenTelemetry semantic conventions,
+	// as in http.route or db.statement.
+	Attrs Kv
+
+	// Logs of the request, for the root span; the offsets are
+	// relative to Started and get exported as span events.
+	Logs []Log
+
+	// Err is the reason the operation failed, if it did.
+	Err error
+
+	tracer Tracer
+}
+
+// Tracer receives the spans as soon as they are ended.
+//
+// Implementations must not hold up the caller, as the spans
+// end on the request path; see OTLPTracer.
+type Tracer interface {
+	Export(*Span) error
+}
+
+// Child starts a new span within this one.
+func (s *Span) Child(name string, kind ...SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := &Span{
+		Trace:   s.Trace,
+		Id:      randomHex(8),
+		Parent:  s.Id,
+		Name:    name,
+		Kind:    INTERNAL,
+		Started: time.Now(),
+		tracer:  s.tracer,
+	}
+	if len(kind) == 1 {
+		child.Kind = kind[0]
+	}
+
+	return child
+}
+
+// Set adds the attributes to the span.
+func (s *Span) Set(kv Kv) {
+	if s == nil {
+		return
+	}
+
+	if s.Attrs == nil {
+		s.Attrs = Kv{}
+	}
+	for k, v := range kv {
+		s.Attrs[k] = v
+	}
+}
+
+// End finishes the span and hands it over to the tracer.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.Ended, s.Err = time.Now(), err
+	if err := s.tracer.Export(s); err != nil {
+		fmt.Println("TRACER EXPORT FAILED:", err)
+	}
+}
+
+// done is End for the deferred calls with a named error.
+func (s *Span) done(err *error) {
+	s.End(*err)
+}
+
+// Elapsed is how long the operation took.
+func (s *Span) Elapsed() time.Duration {
+	return s.Ended.Sub(s.Started)
+}
+
+// rootSpan starts the span of the request, unless the tracing
+// is off or the caller didn't sample the trace.
+func (lv *Lv) rootSpan() *Span {
+	tracer := lv.app.tracer
+	if tracer == nil || !lv.trace.sampled() {
+		return nil
+	}
+
+	req := lv.Request()
+	return &Span{
+		Trace:   lv.trace.Trace,
+		Id:      lv.trace.Span,
+		Parent:  lv.trace.Parent,
+		Name:    req.Method + " " + lv.Path(),
+		Kind:    SERVER,
+		Started: lv.started,
+		Attrs: Kv{
+			"http.method":    req.Method,
+			"http.route":     lv.Path(),
+			"http.target":    req.URL.Path,
+			"http.client_ip": lv.Addr(),
+			"request.id":     lv.id,
+		},
+		tracer: tracer,
+	}
+}
+
+// Span is the span of the request, nil if it's not traced.
+func (lv *Lv) Span() *Span {
+	return lv.span
+}
+
+type spanKey struct{}
+
+// withSpan makes the span the parent of the queries
+// run with the context.
+func withSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func spanFrom(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// sqlSpans is the go-pg hook recording a span per query,
+// within the span found in the query context.
+type sqlSpans struct{}
+
+func (sqlSpans) BeforeQuery(e *pg.QueryEvent) {
+	if parent := spanFrom(e.Ctx); parent != nil {
+		e.Data[spanKey{}] = parent.Child("sql", CLIENT)
+	}
+}
+
+func (sqlSpans) AfterQuery(e *pg.QueryEvent) {
+	span, ok := e.Data[spanKey{}].(*Span)
+	if !ok {
+		return
+	}
+
+	// unformatted, so that the values stay out of the traces
+	statement, _ := e.UnformattedQuery()
+	span.Set(Kv{"db.system": "postgresql", "db.statement": statement})
+	if e.Result != nil {
+		span.Set(Kv{"db.rows": e.Result.RowsAffected()})
+	}
+
+	span.End(e.Error)
+}
@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package levi
+
+import (
+	"bytes"
+	"log/syslog"
+	"sync"
+)
+
+// SyslogLogger sends the human-readable request logs to the
+// local syslog daemon, over its unix socket. The severity of
+// the message follows the worst log of the request.
+type SyslogLogger struct {
+	// Default: "levi".
+	Tag string
+
+	w    *syslog.Writer
+	err  error
+	once sync.Once
+}
+
+func (s *SyslogLogger) Report(lv *Lv) error {
+	s.once.Do(func() {
+		tag := s.Tag
+		if tag == "" {
+			tag = "levi"
+		}
+		s.w, s.err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	})
+	if s.err != nil {
+		return s.err
+	}
+
+	var b bytes.Buffer
+	writeReport(&b, lv)
+	msg := b.String()
+
+	switch lv.Worst() {
+	case PANIC:
+		return s.w.Crit(msg)
+	case ERROR:
+		return s.w.Err(msg)
+	case WARNING:
+		return s.w.Warning(msg)
+	case DEBUG:
+		return s.w.Debug(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
@@ -30,6 +30,7 @@ type HtmlRenderer struct {
 
 	templates *template.Template
 	once      sync.Once
+	reload    bool // in dev
 }
 
 func (t *HtmlRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
@@ -42,7 +43,7 @@ func (t *HtmlRenderer) Render(w io.Writer, name string, data interface{}, c echo
 		return err
 	}
 
-	if IsDev() {
+	if t.reload {
 		if err := t.load(); err != nil {
 			return err
 		}
@@ -0,0 +1,156 @@
+package levi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+)
+
+// traceparent is the W3C trace context of a request.
+//
+//	traceparent: 00-<trace>-<parent>-<flags>
+//
+type traceparent struct {
+	Trace  string // 32 hex, shared by the whole trace
+	Parent string // 16 hex, the caller's span, if any
+	Span   string // 16 hex, ours
+	Flags  string // 2 hex, 01 is sampled
+}
+
+func parseTraceparent(header string) (tp traceparent, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" ||
+		!isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) ||
+		parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return tp, false
+	}
+
+	return traceparent{Trace: parts[1], Parent: parts[2], Flags: parts[3]}, true
+}
+
+// String is the traceparent to pass downstream, our span
+// being the parent there.
+func (tp traceparent) String() string {
+	return "00-" + tp.Trace + "-" + tp.Span + "-" + tp.Flags
+}
+
+func (tp traceparent) sampled() bool {
+	flags, _ := strconv.ParseUint(tp.Flags, 16, 8)
+	return flags&1 == 1
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID keeps the incoming ids from messing with
+// the logs and the headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// identify assigns the request its id and trace context,
+// honouring the incoming X-Request-ID and traceparent.
+func (lv *Lv) identify() {
+	req := lv.Request()
+
+	tp, ok := parseTraceparent(req.Header.Get("traceparent"))
+	id := req.Header.Get(echo.HeaderXRequestID)
+
+	if !ok {
+		u := uuid.New()
+		tp = traceparent{Trace: hex.EncodeToString(u[:]), Flags: "01"}
+		if !validRequestID(id) {
+			id = u.String()
+		}
+	} else if !validRequestID(id) {
+		id = tp.Trace
+	}
+
+	tp.Span = randomHex(8)
+	lv.id, lv.trace = id, tp
+
+	lv.Response().Header().Set(echo.HeaderXRequestID, id)
+	lv.SetRequest(req.WithContext(withTrace(req.Context(), id, tp)))
+}
+
+// RequestID identifies the request in the logs, the response
+// headers and the downstream calls.
+func (lv *Lv) RequestID() string {
+	return lv.id
+}
+
+// TraceID is the W3C trace id the request belongs to.
+func (lv *Lv) TraceID() string {
+	return lv.trace.Trace
+}
+
+// Ctx is the request context, carrying the request id and the
+// trace; it's what gets passed to the queries.
+func (lv *Lv) Ctx() context.Context {
+	return lv.Request().Context()
+}
+
+// NewRequest prepares an outbound HTTP request on behalf of
+// the request: it carries the request id, the traceparent
+// and gets cancelled along with the request.
+func (lv *Lv) NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(lv.Ctx())
+	req.Header.Set(echo.HeaderXRequestID, lv.id)
+	req.Header.Set("traceparent", lv.trace.String())
+	return req, nil
+}
+
+type traceKey struct{}
+
+type traceValue struct {
+	id string
+	tp traceparent
+}
+
+func withTrace(ctx context.Context, id string, tp traceparent) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceValue{id, tp})
+}
+
+// RequestID is the id of the request the context belongs to,
+// or an empty string.
+func RequestID(ctx context.Context) string {
+	v, _ := ctx.Value(traceKey{}).(traceValue)
+	return v.id
+}
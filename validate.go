@@ -0,0 +1,587 @@
+package levi
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Forms are validated by their validate tags, before their
+// own Validate, if any:
+//
+//	type Signup struct {
+//		Login    string `json:"login" validate:"required,min=3,max=32"`
+//		Email    string `json:"email" validate:"required,email"`
+//		Password string `json:"password" validate:"required,min=8"`
+//		Repeat   string `json:"repeat" validate:"eqfield=Password"`
+//		Plan     string `json:"plan" validate:"oneof=free pro"`
+//		Handle   string `json:"handle" validate:"regexp=^[a-z0-9_]+$"`
+//	}
+//
+// The rules are:
+//
+//	required              not the zero value
+//	min=N, max=N, len=N   the value of a number, or the length
+//	                      of a string, slice or map
+//	email, url            well-formed
+//	oneof=a b c           one of the space-separated values
+//	regexp=expr           matches; always the last rule
+//	eqfield=F, nefield=F  equal to (not equal to) the field F
+//	gtfield=F, gtefield=F, ltfield=F, ltefield=F
+//	                      compared to the field F
+//
+// A field that fails required skips the rest of its rules. An
+// empty field that isn't required is still compared to the
+// other fields, and checked by min, max and len if it's a
+// number, but skips the rest of its rules. Nested structs
+// are validated, too; see RegisterRule for the custom rules
+// and RegisterMessages for translations.
+//
+// The tags are compiled once per type; a bad one, such as an
+// unknown rule or a malformed param, is ErrBadRule.
+
+// Rule reports whether the field value passes the rule,
+// given the param after the "=" in the tag, if any.
+type Rule func(v reflect.Value, param string) bool
+
+var validation = struct {
+	sync.RWMutex
+	rules    map[string]Rule
+	params   map[string]func(string) error // of the built-in rules
+	messages map[string]map[string]string  // by language, by rule
+}{
+	rules: map[string]Rule{
+		"min":    measured(func(x, n float64) bool { return x >= n }),
+		"max":    measured(func(x, n float64) bool { return x <= n }),
+		"len":    measured(func(x, n float64) bool { return x == n }),
+		"email":  isEmail,
+		"url":    isURL,
+		"oneof":  isOneOf,
+		"regexp": matches,
+	},
+	params: map[string]func(string) error{
+		"min":    parseNumber,
+		"max":    parseNumber,
+		"len":    parseNumber,
+		"regexp": compileRegexp,
+	},
+	messages: map[string]map[string]string{"en": {
+		"required":  "{field} is required",
+		"min":       "{field} must be at least {param}",
+		"min.len":   "{field} must be at least {param} characters long",
+		"min.items": "{field} must have at least {param} items",
+		"max":       "{field} must be at most {param}",
+		"max.len":   "{field} must be at most {param} characters long",
+		"max.items": "{field} must have at most {param} items",
+		"len":       "{field} must be {param}",
+		"len.len":   "{field} must be exactly {param} characters long",
+		"len.items": "{field} must have exactly {param} items",
+		"email":     "{field} must be a valid email address",
+		"url":       "{field} must be a valid URL",
+		"oneof":     "{field} must be one of: {param}",
+		"regexp":    "{field} is malformed",
+		"eqfield":   "{field} must match {param}",
+		"nefield":   "{field} must differ from {param}",
+		"gtfield":   "{field} must be greater than {param}",
+		"gtefield":  "{field} must be at least {param}",
+		"ltfield":   "{field} must be less than {param}",
+		"ltefield":  "{field} must be at most {param}",
+		"":          "{field} is invalid",
+	}},
+}
+
+// regexps are the compiled regexp rules.
+var regexps sync.Map
+
+// plans are the compiled forms, by type, see planOf.
+var plans sync.Map
+
+// RegisterRule adds a custom validation rule, or replaces
+// a built-in one; the optional message is the English one.
+//
+//	levi.RegisterRule("slug", isSlug, "{field} must be a slug")
+//
+func RegisterRule(name string, rule Rule, message ...string) {
+	validation.Lock()
+	defer validation.Unlock()
+
+	validation.rules[name] = rule
+	delete(validation.params, name)
+	if len(message) == 1 {
+		validation.messages["en"][name] = message[0]
+	}
+	forgetPlans()
+}
+
+// RegisterMessages adds the translations of the messages for
+// the language, as in "de" or "pt-br", picked by the request's
+// Accept-Language; {field} and {param} are substituted.
+//
+// The keys are the rule names; min, max and len also have the
+// ".len" variants for strings and the ".items" variants for
+// slices and maps. The "" key is the fallback.
+func RegisterMessages(lang string, messages map[string]string) {
+	validation.Lock()
+	defer validation.Unlock()
+
+	lang = strings.ToLower(lang)
+	if validation.messages[lang] == nil {
+		validation.messages[lang] = map[string]string{}
+	}
+	for rule, msg := range messages {
+		validation.messages[lang][rule] = msg
+	}
+}
+
+// Validate checks the validate tags of the form, collecting
+// every failure into a ValidationError, with the messages in
+// the language of the request.
+func (lv *Lv) Validate(form interface{}) error {
+	return ValidateIn(form, lv.Request().Header.Get("Accept-Language"))
+}
+
+// ValidateIn is Validate outside of a request; lang is an
+// Accept-Language header value, English is the fallback.
+func ValidateIn(form interface{}, lang string) error {
+	v := reflect.Indirect(reflect.ValueOf(form))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	validation.RLock()
+	defer validation.RUnlock()
+
+	p, err := planOf(v.Type())
+	if err != nil {
+		return err
+	}
+
+	var failures []FieldError
+	p.validate(v, "", language(lang), &failures)
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return &ValidationError{
+		Field:   failures[0].Field,
+		Message: failures[0].Message,
+		Errors:  failures,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// plan is the validation of a struct type, compiled from its
+// validate tags.
+type plan struct {
+	fields []fieldPlan
+}
+
+type fieldPlan struct {
+	index    int
+	name     string
+	required bool
+	rules    []rulePlan
+	// the struct to validate in turn, if any
+	nested   *plan
+	embedded bool
+}
+
+type rulePlan struct {
+	name, param string
+	check       Rule
+	// the cross-field rules compare with the other field
+	cmp       func(int, bool) bool
+	other     []int
+	otherName string
+}
+
+type compiled struct {
+	plan *plan
+	err  error
+}
+
+// planOf compiles the struct type, or takes it from plans;
+// the caller holds the validation lock.
+func planOf(t reflect.Type) (*plan, error) {
+	if c, ok := plans.Load(t); ok {
+		return c.(compiled).plan, c.(compiled).err
+	}
+
+	p, err := compilePlan(t, map[reflect.Type]*plan{})
+	plans.Store(t, compiled{p, err})
+	return p, err
+}
+
+// forgetPlans drops the compiled plans, once the rules change.
+func forgetPlans() {
+	plans.Range(func(t, _ interface{}) bool {
+		plans.Delete(t)
+		return true
+	})
+}
+
+// compilePlan compiles the type and its nested structs; seen
+// are the ones compiled so far, for the types that nest
+// themselves.
+func compilePlan(t reflect.Type, seen map[reflect.Type]*plan) (*plan, error) {
+	if p, ok := seen[t]; ok {
+		return p, nil
+	}
+
+	p := &plan{}
+	seen[t] = p
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		fp := fieldPlan{index: i, name: fieldName(f), embedded: f.Anonymous}
+		if tag, ok := f.Tag.Lookup("validate"); ok && tag != "-" {
+			if err := fp.compile(t, tag); err != nil {
+				return nil, fmt.Errorf("%w: %s.%s: %v", ErrBadRule, t, f.Name, err)
+			}
+		}
+
+		nested := f.Type
+		if nested.Kind() == reflect.Ptr {
+			nested = nested.Elem()
+		}
+		if nested.Kind() == reflect.Struct && nested != timeType {
+			np, err := compilePlan(nested, seen)
+			if err != nil {
+				return nil, err
+			}
+			fp.nested = np
+		}
+
+		if fp.required || len(fp.rules) != 0 || fp.nested != nil {
+			p.fields = append(p.fields, fp)
+		}
+	}
+
+	return p, nil
+}
+
+func (fp *fieldPlan) compile(form reflect.Type, tag string) error {
+	for _, r := range splitRules(tag) {
+		rule := rulePlan{name: r[0], param: r[1]}
+		if rule.name == "required" {
+			fp.required = true
+			continue
+		}
+
+		if cmp, ok := crossField[rule.name]; ok {
+			other, ok := form.FieldByName(rule.param)
+			if !ok {
+				return fmt.Errorf("no field %s to compare with", rule.param)
+			}
+			rule.cmp, rule.other, rule.otherName = cmp, other.Index, fieldName(other)
+			fp.rules = append(fp.rules, rule)
+			continue
+		}
+
+		check, ok := validation.rules[rule.name]
+		if !ok {
+			return fmt.Errorf("unknown rule %q", rule.name)
+		}
+		if parse, ok := validation.params[rule.name]; ok {
+			if err := parse(rule.param); err != nil {
+				return fmt.Errorf("%s=%s: %v", rule.name, rule.param, err)
+			}
+		}
+		rule.check = check
+		fp.rules = append(fp.rules, rule)
+	}
+
+	return nil
+}
+
+func (p *plan) validate(v reflect.Value, prefix string, messages []map[string]string, failures *[]FieldError) {
+	for i := range p.fields {
+		f := &p.fields[i]
+		field := v.Field(f.index)
+		name := prefix + f.name
+
+		f.validate(v, field, name, messages, failures)
+
+		if f.nested == nil {
+			continue
+		}
+		nested := reflect.Indirect(field)
+		switch {
+		case !nested.IsValid():
+		case f.embedded:
+			f.nested.validate(nested, prefix, messages, failures)
+		default:
+			f.nested.validate(nested, name+".", messages, failures)
+		}
+	}
+}
+
+func (f *fieldPlan) validate(form, field reflect.Value, name string, messages []map[string]string, failures *[]FieldError) {
+	value := reflect.Indirect(field)
+	empty := !value.IsValid() || value.IsZero()
+	if empty && f.required {
+		fail(failures, messages, name, "required", "", "")
+		return
+	}
+
+	_, isNumber := number(value)
+	for _, r := range f.rules {
+		if r.cmp != nil {
+			other := reflect.Indirect(fieldByIndex(form, r.other))
+			if !r.cmp(compare(value, other)) {
+				fail(failures, messages, name, r.name, "", r.otherName)
+			}
+			continue
+		}
+
+		// there's nothing to check in an empty value,
+		// but the bounds of a number
+		if empty && !(isNumber && measures(r.name)) {
+			continue
+		}
+
+		if !r.check(value, r.param) {
+			fail(failures, messages, name, r.name, variant(r.name, value), r.param)
+		}
+	}
+}
+
+func fail(failures *[]FieldError, messages []map[string]string, field, rule, variant, param string) {
+	var msg string
+lookup:
+	for _, m := range messages {
+		for _, key := range []string{rule + variant, rule, ""} {
+			if msg = m[key]; msg != "" {
+				break lookup
+			}
+		}
+	}
+
+	msg = strings.NewReplacer("{field}", field, "{param}", param).Replace(msg)
+	*failures = append(*failures, FieldError{field, rule, msg})
+}
+
+// splitRules splits the tag into the rule-param pairs;
+// regexp consumes the rest of the tag, commas and all.
+func splitRules(tag string) [][2]string {
+	var rules [][2]string
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regexp=") {
+			rule, tag = tag, ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		name, param := rule, ""
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			name, param = rule[:i], rule[i+1:]
+		}
+		rules = append(rules, [2]string{strings.TrimSpace(name), param})
+	}
+	return rules
+}
+
+// fieldName is the name the client knows the field by.
+func fieldName(f reflect.StructField) string {
+	for _, key := range []string{"json", "form", "query"} {
+		if name := strings.Split(f.Tag.Get(key), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// language is the list of message sets to look the messages
+// up in, by preference, ending with English.
+func language(accept string) []map[string]string {
+	var sets []map[string]string
+	for _, part := range strings.Split(accept, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		if tag == "" {
+			continue
+		}
+		if m, ok := validation.messages[tag]; ok {
+			sets = append(sets, m)
+		}
+		if i := strings.IndexByte(tag, '-'); i > 0 {
+			if m, ok := validation.messages[tag[:i]]; ok {
+				sets = append(sets, m)
+			}
+		}
+	}
+	return append(sets, validation.messages["en"])
+}
+
+func measures(rule string) bool {
+	return rule == "min" || rule == "max" || rule == "len"
+}
+
+func variant(rule string, v reflect.Value) string {
+	if !measures(rule) {
+		return ""
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return ".len"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return ".items"
+	}
+	return ""
+}
+
+// measured compares the number, or the length, to the param.
+func measured(ok func(x, n float64) bool) Rule {
+	return func(v reflect.Value, param string) bool {
+		n, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return false
+		}
+
+		switch v.Kind() {
+		case reflect.String:
+			return ok(float64(utf8.RuneCountInString(v.String())), n)
+		case reflect.Slice, reflect.Map, reflect.Array:
+			return ok(float64(v.Len()), n)
+		}
+
+		x, isNumber := number(v)
+		return isNumber && ok(x, n)
+	}
+}
+
+func isEmail(v reflect.Value, _ string) bool {
+	addr, err := mail.ParseAddress(v.String())
+	return err == nil && addr.Address == v.String()
+}
+
+func isURL(v reflect.Value, _ string) bool {
+	u, err := url.ParseRequestURI(v.String())
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+func isOneOf(v reflect.Value, param string) bool {
+	s := fmt.Sprint(v.Interface())
+	for _, option := range strings.Fields(param) {
+		if s == option {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(v reflect.Value, expr string) bool {
+	re, ok := regexps.Load(expr)
+	if !ok {
+		compiled, err := regexp.Compile(expr)
+		if err != nil {
+			return false
+		}
+		re, _ = regexps.LoadOrStore(expr, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(v.String())
+}
+
+func parseNumber(param string) error {
+	_, err := strconv.ParseFloat(param, 64)
+	return err
+}
+
+func compileRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err == nil {
+		regexps.Store(expr, re)
+	}
+	return err
+}
+
+var crossField = map[string]func(int, bool) bool{
+	"eqfield":  func(c int, ok bool) bool { return ok && c == 0 },
+	"nefield":  func(c int, ok bool) bool { return !ok || c != 0 },
+	"gtfield":  func(c int, ok bool) bool { return ok && c > 0 },
+	"gtefield": func(c int, ok bool) bool { return ok && c >= 0 },
+	"ltfield":  func(c int, ok bool) bool { return ok && c < 0 },
+	"ltefield": func(c int, ok bool) bool { return ok && c <= 0 },
+}
+
+// fieldByIndex is reflect's FieldByIndex, but for the nil
+// embedded pointers on the way, that make the field invalid.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// compare compares the values of the same kind: numbers,
+// strings and times; ok is false if they aren't comparable.
+func compare(a, b reflect.Value) (c int, ok bool) {
+	if !a.IsValid() || !b.IsValid() {
+		return 0, false
+	}
+
+	sign := func(less, greater bool) int {
+		switch {
+		case less:
+			return -1
+		case greater:
+			return 1
+		}
+		return 0
+	}
+
+	if a.Type() == timeType && b.Type() == timeType {
+		x, y := a.Interface().(time.Time), b.Interface().(time.Time)
+		return sign(x.Before(y), x.After(y)), true
+	}
+
+	switch a.Kind() {
+	case reflect.String:
+		if b.Kind() == reflect.String {
+			return strings.Compare(a.String(), b.String()), true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		x, xok := number(a)
+		y, yok := number(b)
+		return sign(x < y, x > y), xok && yok
+	case reflect.Bool:
+		if b.Kind() == reflect.Bool && a.Bool() == b.Bool() {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func number(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}